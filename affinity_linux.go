@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const affinitySupported = true
+
+// numaCPUs returns the CPUs of the NUMA node, as listed in sysfs.
+func numaCPUs(node int) ([]int, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/sys/devices/system/node/node%d/cpulist", node))
+	if err != nil {
+		return nil, err
+	}
+	var cpus []int
+	for _, r := range strings.Split(strings.TrimSpace(string(b)), ",") {
+		if r == "" {
+			continue
+		}
+		lo, hi := r, r
+		if i := strings.IndexByte(r, '-'); i >= 0 {
+			lo, hi = r[:i], r[i+1:]
+		}
+		from, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("node%d: invalid cpulist %q", node, r)
+		}
+		to, err := strconv.Atoi(hi)
+		if err != nil {
+			return nil, fmt.Errorf("node%d: invalid cpulist %q", node, r)
+		}
+		for c := from; c <= to; c++ {
+			cpus = append(cpus, c)
+		}
+	}
+	if len(cpus) == 0 {
+		return nil, fmt.Errorf("node%d has no CPUs", node)
+	}
+	return cpus, nil
+}
+
+// pinThread locks the calling goroutine to its OS thread and restricts
+// the thread to the CPUs.
+func pinThread(cpus []int) error {
+	max := 0
+	for _, c := range cpus {
+		if c > max {
+			max = c
+		}
+	}
+	mask := make([]uint64, max/64+1)
+	for _, c := range cpus {
+		mask[c/64] |= 1 << uint(c%64)
+	}
+	runtime.LockOSThread()
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
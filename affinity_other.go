@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+const affinitySupported = false
+
+func numaCPUs(node int) ([]int, error) {
+	return nil, nil
+}
+
+func pinThread(cpus []int) error {
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errorLog writes the errors met during the walk to a file as a JSON
+// array, or as one JSON object per line when stream is set so the file
+// stays readable while -inotify keeps running.
+type errorLog struct {
+	mu     sync.Mutex
+	f      *os.File
+	n      int
+	stream bool
+}
+
+type walkError struct {
+	Op    string    `json:"op"`
+	Path  string    `json:"path"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+var walkErrors *errorLog
+
+func openErrorLog(name string, stream bool) (*errorLog, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if !stream {
+		if _, err := f.WriteString("["); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &errorLog{f: f, stream: stream}, nil
+}
+
+// logWalkError counts err, and records it for path if -walk-errors-json is
+// given.
+func logWalkError(op, path string, err error) {
+	atomic.AddInt64(&errorCount, 1)
+	if walkErrors == nil {
+		return
+	}
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	walkErrors.add(walkError{
+		Op:    op,
+		Path:  filepath.ToSlash(path),
+		Error: err.Error(),
+		Time:  time.Now().UTC().Truncate(time.Second),
+	})
+}
+
+func (l *errorLog) add(e walkError) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case l.stream:
+		b = append(b, '\n')
+	case l.n > 0:
+		b = append([]byte(",\n"), b...)
+	}
+	l.f.Write(b)
+	l.n++
+}
+
+// close terminates the array and closes the file.
+func (l *errorLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.stream {
+		if _, err := l.f.WriteString("]\n"); err != nil {
+			l.f.Close()
+			return err
+		}
+	}
+	return l.f.Close()
+}
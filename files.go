@@ -1,16 +1,26 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
+	"io"
+	"math"
 	"os"
+	"os/user"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 var (
@@ -19,260 +29,3181 @@ var (
 	async         = flag.Bool("A", false, "Asynchronized find")
 	absolute      = flag.Bool("a", false, "Display absolute path")
 	fsort         = flag.Bool("s", false, "Sort results")
-	match         = flag.String("m", "", "Display matched files")
+	match         = flag.String("m", "", "Display files whose name matches the pattern anywhere in it")
 	maxfiles      = flag.Int64("M", -1, "Max files")
 	directoryOnly = flag.Bool("d", false, "Directory only")
+	printCounts   = flag.Bool("print-counts", false, "Print total count of results as the last line")
+	sparse        = flag.String("sparse", "include", "Sparse files: include, exclude or only")
+	minBlocks     = flag.Int64("min-blocks", -1, "Min 512-byte blocks on disk")
+	maxBlocks     = flag.Int64("max-blocks", -1, "Max 512-byte blocks on disk")
+	countSymlinks = flag.Bool("count-symlinks", false, "Print count of symlinks in results after them")
+	nlinksMin     = flag.Int64("nlinks-min", -1, "Min number of hard links")
+	nlinksMax     = flag.Int64("nlinks-max", -1, "Max number of hard links")
+	excludeNewer  = flag.String("exclude-newer", "", "Skip files modified after `FILE`")
+	skipLarger    = sizeFlag("skip-larger", -1, "Skip files larger than N bytes (K, M, G, T suffixes)")
+	fdLimit       = flag.Int("fd-limit", 0, "Max simultaneously open file descriptors (default 90% of the limit)")
+	statCacheFile = flag.String("stat-cache", "", "Cache stat results in the file between runs")
+	encodingCheck = flag.Bool("encoding-check", false, "Warn about non-UTF-8 file names")
+	skipInvalid   = flag.Bool("skip-invalid-encoding", false, "Skip non-UTF-8 file names")
+	minNameLen    = flag.Int("min-name-length", -1, "Min length of file names in bytes")
+	maxNameLen    = flag.Int("max-name-length", -1, "Max length of file names in bytes")
+	inRunes       = flag.Bool("in-runes", false, "Count name lengths in characters instead of bytes")
+	linkTargetDir = flag.String("link-target-base", "", "Warn about symlinks whose targets are outside the directory")
+	skipEscaping  = flag.Bool("skip-escaping-links", false, "Skip symlinks whose targets are outside -link-target-base")
+	fsWalk        = flag.Bool("file-system-walk", false, "Walk the root of each mounted filesystem instead of the base")
+	localOnly     = flag.Bool("local-only", false, "Skip network filesystems with -file-system-walk")
+	noCrossLink   = flag.Bool("no-cross-symlink", false, "Skip symlinks whose targets are outside the base")
+	checkExecBit  = flag.Bool("check-executable-bit", false, "Warn about scripts with a shebang line which are not executable")
+	shebang       = flag.Bool("shebang", false, "Check all files for shebang lines with -check-executable-bit")
+	nullByteCheck = flag.Bool("null-byte-check", false, "Warn about file names containing null bytes")
+	skipNullByte  = flag.Bool("skip-null-byte", false, "Skip file names containing null bytes")
+	inotify       = flag.Bool("inotify", false, "Stream created (+) and deleted (-) files after listing")
+	findGitRepos  = flag.Bool("find-git-repos", false, "Display the roots of git repositories, not walking into them")
+	recurseRepos  = flag.Bool("recurse-git-repos", false, "Also look for repositories inside those found with -find-git-repos")
+	walkErrsJSON  = flag.String("walk-errors-json", "", "Write the errors met during the walk to `FILE` as a JSON array")
+	ignoreTemp    = flag.Bool("ignore-temp-files", false, "Ignore well-known temporary files: editor swap and backup files, OS metadata and build artifacts")
+	tempPatFile   = flag.String("temp-files-pattern-file", "", "Read the temporary file patterns from `FILE`, one per line, instead of the built-in ones (implies -ignore-temp-files)")
+	listTempPats  = flag.Bool("list-temp-patterns", false, "List the built-in temporary file patterns and exit")
+	printIndent   = flag.Bool("print-indent", false, "Display names indented by their depth below the base")
+	indentString  = flag.String("indent-string", "  ", "Indentation per level with -print-indent")
+	byMonth       = flag.Bool("summarize-by-month", false, "Print counts and total sizes of files per modification month instead of files")
+	walkSymDirs   = flag.Bool("walk-symlink-dirs", false, "Walk into symlinks to directories as if they were directories")
+	sizeFormat    = flag.String("size-format", "bytes", "Display sizes as bytes, si (kB, MB) or iec (KiB, MiB)")
+	pathComps     = flag.Int("print-path-components", 0, "Display only the last `N` components of paths")
+	coalesceExts  = flag.Bool("coalesce-extensions", false, "Treat compound extensions like .tar.gz as one extension")
+	compoundExts  = stringListFlag("compound-ext", "Treat `EXT` as one extension, may be given more than once (implies -coalesce-extensions)")
+	jsonPretty    = flag.Bool("json-stream-pretty", false, "Space out the keys and values of -format json, keeping an object per line")
+	jsonIndent    = flag.Int("json-pretty-indent", 0, "Indent -format json objects by `N` spaces over several lines, which is no longer NDJSON")
+	printSumTree  = flag.Bool("print-checksum-tree", false, "Print a hash of each directory from the names, sizes and mtimes of the files below it")
+	ignoreCase    = flag.Bool("ignore-case-paths", false, "Compare paths case-insensitively (probed for on darwin and windows)")
+	omitDirs      = flag.String("omit-dirs", "", "Skip directories with these comma separated names, matched exactly and case-sensitively")
+	pathSep       = flag.String("path-sep", "", "Separate the components of displayed paths with `SEP` instead of /")
+	showVersion   = flag.Bool("version", false, "Print the version and exit")
+	checkUpdate   = flag.Bool("check-for-update", false, "Tell whether a newer release is available and exit")
+	noUpdateCheck = flag.Bool("no-update-check", false, "Don't look for a newer release, overriding -check-for-update")
+	printAge      = flag.Bool("print-mod-time-age", false, "Prepend how long ago files were modified, like \"3 days ago\"")
+	agePrecision  = flag.String("age-precision", "minutes", "Smallest unit of -print-mod-time-age: seconds, minutes, hours or days")
+	walkDirLimit  = flag.Int64("walk-dir-limit", 0, "Stop walking into directories after `N` of them")
+	noOutput      = flag.Bool("no-output", false, "Walk without displaying anything, for timing the walk")
+	previewBytes  = flag.Int("content-preview", 0, "Append the first `N` bytes of each file")
+	walkModel     = flag.String("walk-concurrency-model", "goroutine", "How -A walks directories: goroutine (one per directory) or pool (a worker per CPU)")
+	matchFullPath = flag.Bool("match-full-path", false, "Match -m against the whole path from the base instead of the name")
+	ioAffinity    = flag.Int("walk-io-affinity", -1, "Keep the walk on the CPUs of NUMA `NODE` (Linux, implies -walk-concurrency-model pool)")
+	reportDenied  = flag.Bool("report-inaccessible-dirs", false, "Print the number of directories which couldn't be read for lack of permission to stderr")
+	zeroSizeDirs  = flag.Bool("find-zero-size-dirs", false, "Print directories whose files are all empty instead of files")
+	minNonzero    = flag.Int("min-nonzero-files", 1, "Directories with fewer than `N` non-empty files count as empty with -find-zero-size-dirs")
+	watchNoInit   = flag.Bool("watch-ignore-initial", false, "Stream changes like -inotify without listing the existing files first")
+	gitConfigs    = stringListFlag("git-config", "Add the value of the git config `KEY` to the ignore pattern, may be given more than once")
+	gitConfigAs   = flag.String("git-config-as", "ignore", "Use -git-config values as ignore or match patterns")
+	dirMetadata   = flag.Bool("emit-dir-metadata", false, "Emit dir_start and dir_end objects around the files of each directory with -format json")
+	validateOut   = flag.Bool("validate-output", false, "Check that each file still exists before displaying it, skipping it with a warning if not")
+	validateExit  = flag.Bool("validation-error-exit", false, "Exit with status 1 if -validate-output skipped any file (implies -validate-output)")
+	printDevice   = flag.Bool("print-device", false, "Prepend the ID of the device each file is on")
+	splitOutput   = flag.Int("split-output", 0, "Write the results round-robin to `N` files instead of stdout")
+	splitPrefix   = flag.String("split-output-prefix", "files", "Name the -split-output files `PREFIX`.0, PREFIX.1, ...")
+	splitByHash   = flag.Bool("split-output-hash", false, "Pick the -split-output file by a hash of the path, the same on every run")
+	noEmptyExt    = flag.Bool("no-empty-extensions", false, "Skip files without an extension, like Makefile")
+	onlyNoExt     = flag.Bool("only-extensionless", false, "Display files without an extension only")
+	statLatency   = flag.Bool("stat-latency", false, "Print the 10 directories slowest to read to stderr")
+	byOwner       = flag.Bool("aggregate-by-owner", false, "Print counts and total sizes of files per owner instead of files")
+	dirThrottle   = flag.Duration("walk-throttle-per-dir", 0, "Pause for the duration after reading each directory")
+	printChain    = flag.Bool("print-symlink-chain", false, "Follow each symlink to its final target and display every link on the way")
+	noCrossMount  = flag.Bool("no-cross-mount", false, "Don't walk into other filesystems, reporting each mount point skipped")
+	manifestFmt   = flag.String("output-manifest-format", "make", "Format of -write-manifest: make, cmake or ninja")
+	minEntropy    = flag.Float64("min-entropy", 0, "Display files whose first 4KB have at least `BITS` of entropy per byte, like encrypted or compressed data")
+	walkStatsFile = flag.String("walk-stats-file", "", "Write walk statistics as JSON to `FILE` every -walk-stats-interval")
+	statsInterval = flag.Duration("walk-stats-interval", 5*time.Second, "Interval of -walk-stats-file")
+	gitTracked    = flag.Bool("git-tracked", false, "Display files tracked by git only")
+	gitUntracked  = flag.Bool("git-untracked", false, "Display files not tracked by git only")
+	repoRoot      = flag.Bool("repo-root", false, "Use the repository root as the base")
+	repoRootType  = flag.String("repo-root-type", "auto", "Repository type for -repo-root: git, hg, svn or auto")
+	printBase     = flag.Bool("print-base", false, "Print the resolved base directory as the first line")
+	printExts     = flag.Bool("print-extensions", false, "Print counts of unique extensions instead of files")
+	extCaseFold   = flag.Bool("ext-case-fold", runtime.GOOS == "windows" || runtime.GOOS == "darwin", "Compare extensions case-insensitively")
+	absSymlink    = flag.Bool("abs-symlink", false, "Resolve symlinks in the base before walking")
+	hiddenOnly    = flag.Bool("hidden-only", false, "Display files and directories whose names, or those of directories they are in, start with a dot only")
+	readDirBatch  = flag.Int("read-dir-batch", 256, "Read directory entries `N` at a time (0 for all at once)")
+	statFields    = flag.String("walk-stat-fields", "none", "Entries stat'd while reading directories: none, basic (regular files) or full")
+	atomicOutput  = flag.Bool("atomic-output", false, "Write all results to stdout at once when finished")
+	atomicMaxMem  = sizeFlag("atomic-output-max-memory", -1, "Buffer -atomic-output in a temporary file above N bytes")
+	minDepthFiles = flag.Int("min-depth-files", 0, "Skip files less than N levels below the base")
+	devFiles      = flag.Bool("dev-files", false, "Display block and character device files")
+	noBlockDevs   = flag.Bool("no-block-devices", false, "Skip block device files with -dev-files")
+	noCharDevs    = flag.Bool("no-char-devices", false, "Skip character device files with -dev-files")
+	specialFiles  = flag.Bool("include-special", false, "Display named pipes and sockets")
+	progressFile  = flag.String("progress-file", "", "Write progress as JSON to the file every second")
+	outputHash    = flag.String("output-hash", "", "Append a checksum of the output above it: md5, sha1, sha256 or sha512")
+	onlyModified  = flag.Bool("only-modified", false, "Display files modified since HEAD only")
+	onlyStaged    = flag.Bool("only-staged", false, "Display files staged for commit only")
+	sinceCommit   = flag.String("since-commit", "", "Display files changed since the git commit")
+	sinceTag      = flag.String("since-tag", "", "Display files changed since the git tag")
+	ignoreAnchor  = flag.Bool("ignore-anchored", false, "Match -i against the path from the base, anchored at its start")
+	matchAnchored = flag.Bool("match-anchored", false, "Match -m against the path from the base, anchored at its start")
+	noRecurse     = flag.Bool("no-recurse", false, "Display immediate children of the base only (same as max depth 1)")
+	treeCount     = flag.Bool("tree-count", false, "Print the number of files, directories and other nodes in the tree")
+	dirFilterCmd  = flag.String("content-filter-dir", "", "Run the script for each directory and ignore the patterns it prints below it")
+	maxTotalSize  = sizeFlag("max-total-size", -1, "Stop when the total size of files exceeds N bytes (K, M, G, T suffixes)")
+	preserveOrder = flag.Bool("preserve-order", false, "Display entries of each directory in name order with -A")
+	levelOrder    = flag.Bool("level-order", false, "Walk breadth-first, displaying shallower entries first")
+	reverseDepth  = flag.Bool("reverse-depth", false, "Display deepest entries first, each directory after its contents")
+	checkPerms    = flag.String("check-perms", "", "Display files whose permission bits match MASK:VALUE (octal) or VALUE")
+	checkModeMax  = flag.String("check-mode-max", "", "Display files with permission bits beyond the octal mode only")
+	worldWritable = flag.Bool("world-writable", false, "Display world-writable files only (-check-perms 0002:0002)")
+	setuid        = flag.Bool("setuid", false, "Display setuid files only (-check-perms 04000:04000)")
+	uidFlag       = flag.String("uid", "", "Display files owned by the user ID, ID range (N-M) or name")
+	gidFlag       = flag.String("gid", "", "Display files owned by the group ID, ID range (N-M) or name")
+	printACL      = flag.Bool("print-acl", false, "Append the POSIX ACL of each file")
+	printSELinux  = flag.Bool("print-selinux", false, "Append the SELinux security context of each file")
+	format        = flag.String("format", "text", "Output format: text, table, table-no-header, csv or json")
+	walkDirHook   = flag.String("walk-dir-hook", "", "Run the command for each directory before reading it and display the paths it prints")
+	fileHookCmd   = flag.String("file-hook", "", "Run the command for each file and display the file only if it succeeds")
+	hookTimeout   = flag.Duration("hook-timeout", 5*time.Second, "Timeout of each hook command")
+	countByDir    = flag.Bool("count-by-dir", false, "Print counts of files per directory instead of files")
+	targetOnly    = flag.Bool("target-only", false, "Display the real path of each file, resolving symlinks")
+	skipBroken    = flag.Bool("skip-broken-links", false, "Skip broken symlinks with -target-only")
+	brokenLinks   = flag.Bool("broken-links", false, "Report broken symlinks with -target-only")
+	fileNumber    = flag.Bool("n", false, "Prepend line numbers")
+	fileNumberSep = flag.String("file-number-sep", "\t", "Separator after line numbers with -n")
+	maxLinkDepth  = flag.Int("max-link-depth", 40, "Max symlinks followed when resolving paths")
+	printRealpath = flag.Bool("print-realpath", false, "Display absolute paths with symlinked directories resolved")
+	realpathCache = flag.Bool("print-realpath-cache", false, "Same as -print-realpath, caching resolved directories")
+	linkGroups    = flag.Bool("print-hardlink-groups", false, "Print hard-linked files together on one line")
+	printLinks    = flag.Bool("print-link-count", false, "Prepend the hard link count of each file")
+	stripPrefix   = flag.Bool("strip-common-prefix", false, "Remove the directory prefix shared by all results")
+	printGitRoot  = flag.Bool("print-git-root", false, "Prefix each path with the root of its git repository")
+	printSHA      = flag.Bool("print-sha", false, "Display the SHA-256 hash of each path instead of the path")
+	salt          = flag.String("salt", "", "Hash paths with HMAC-SHA256 keyed with the string")
+	verifyHashes  = flag.String("verify", "", "Compare path hashes with the list in `FILE`, printing added (+) and removed (-) ones")
+	printType     = flag.Bool("print-type", false, "Append a file type indicator like ls -F")
+	omitPatterns  = regexpListFlag("omit-pattern", "Omit displayed paths matching `PATTERN` (may be repeated)")
+	printDiffFrom = flag.String("print-diff-from", "", "Mark files added (+) and removed (-) since the output saved in `FILE`")
+	findLargeDirs = flag.Int("find-large-dirs", 0, "Warn about directories with more than `N` files directly in them")
+	walkBudget    = flag.Duration("walk-budget", 0, "Skip directories taking longer than the duration to read")
+	createIndex   = flag.String("create-index", "", "Save the results with their stat fields to an index `FILE`")
+	queryIndex    = flag.String("query-index", "", "Display files from an index `FILE` instead of walking")
+	writeManif    = flag.String("write-manifest", "", "Write the results to `FILE` as a build system variable")
+	manifestVar   = flag.String("manifest-var", "SOURCES", "Variable name for -write-manifest")
+	walkTest      = flag.Bool("walk-test", false, "Walk without displaying files and print a summary of what would be displayed")
+	progressJSON  = flag.String("progress-json", "", "Send progress as JSON lines to clients of the unix socket every second")
+	showQueueLen  = flag.Bool("walk-queue-depth", false, "Print the number of directories waiting to be read to stderr every second")
+	metricPort    = flag.Int("metric-port", 0, "Serve walk metrics for Prometheus at /metrics on localhost:`PORT`")
+	parallelOut   = flag.Int("parallel-output", 0, "Format output with `N` goroutines writing to temporary files")
+	listFileFmts  = flag.Bool("list-file-formats", false, "List the values of -format and exit")
+	noHeader      = flag.Bool("no-header", false, "Omit the header row of table and csv output")
+	columns       = flag.String("columns", "", "Comma separated output columns: PATH, PATH_HASH, SIZE, MTIME, AGE, MODE, OWNER, NLINKS, DEVICE, DEVICE_MAJOR, DEVICE_MINOR, DEVICE_TYPE, RDEV_MAJOR, RDEV_MINOR, SYMLINK_CHAIN, GIT_ROOT, ACL, SELINUX_CONTEXT, PREVIEW")
+	fromGitStash  = optionalIntFlag("from-git-stash", "Display files in the git stash (-from-git-stash=N for stash N)")
 )
 
+func init() {
+	flag.StringVar(ignore, "ignore", *ignore, "Ignore directory (same as -i)")
+	flag.BoolVar(progress, "show-progress", *progress, "Progress message (same as -p)")
+	flag.BoolVar(absolute, "show-absolute-paths", *absolute, "Display absolute path (same as -a)")
+	flag.StringVar(match, "match", *match, "Display matched files (same as -m)")
+	flag.Int64Var(maxfiles, "max-files", *maxfiles, "Max files (same as -M)")
+	flag.BoolVar(fileNumber, "file-number", *fileNumber, "Prepend line numbers (same as -n)")
+}
+
 var (
-	ignorere *regexp.Regexp
-	matchre  *regexp.Regexp
-	maxcount = int64(^uint64(0) >> 1)
-	maxError = errors.New("Overflow max count")
+	ignorere  *regexp.Regexp
+	matchre   *regexp.Regexp
+	maxcount  = int64(^uint64(0) >> 1)
+	maxError  = errors.New("Overflow max count")
+	sizeError = errors.New("Overflow max total size")
+
+	symlinkCount int64
+	totalSize    int64
+	sizeExceeded int32
+	treeCounts   [4]int64 // files, dirs, symlinks, other
+	statCache    *dirCache
+	readSem      chan struct{} // limits the files opened to read their content
+	dirsEntered  int64
+	dirLimitOnce sync.Once
+	walkCPUs     []int
+	mountEvents  bool
+	watcher      *dirWatcher
+	omitDirNames map[string]bool
+	allowlist    map[string]bool
+	stdout       io.Writer = os.Stdout
+	root         string
+	permChecks   []permCheck
+	uidRange     *idRange
+	gidRange     *idRange
+	maxMode      *os.FileMode
+	linkBase     string
+	rootAbs      string
+	mounts       map[string]bool // mount points with -file-system-walk
+	newestTime   time.Time
 )
 
-func env(key, def string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	n, err := parseSize(s)
+	if err != nil {
+		return err
 	}
-	return def
+	*b = byteSize(n)
+	return nil
 }
 
-func filesSync(base string) chan string {
-	q := make(chan string, 20)
+// optionalInt is a flag which may be given alone, like a boolean flag, or
+// with a value as -name=N.
+type optionalInt struct {
+	set bool
+	n   int
+}
 
-	go func() {
-		n := int64(0)
-		sep := string(os.PathSeparator)
-		if !strings.HasSuffix(base, sep) {
-			base += sep
+func (o *optionalInt) String() string {
+	if o == nil || !o.set {
+		return ""
+	}
+	return strconv.Itoa(o.n)
+}
+
+func (o *optionalInt) Set(s string) error {
+	switch s {
+	case "true":
+		o.set, o.n = true, 0
+	case "false":
+		o.set = false
+	default:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
 		}
-		processMatch := func(path string, info os.FileInfo) error {
-			if matchre != nil && !matchre.MatchString(info.Name()) {
-				return nil
-			}
+		o.set, o.n = true, n
+	}
+	return nil
+}
 
-			n++
-			if n > maxcount {
-				return maxError
-			}
-			if *progress {
-				if n%10 == 0 {
-					fmt.Fprintf(os.Stderr, "\r%d            \r", n)
-				}
-			}
-			q <- filepath.ToSlash(path)
+func (o *optionalInt) IsBoolFlag() bool {
+	return true
+}
 
-			return nil
-		}
+func optionalIntFlag(name, usage string) *optionalInt {
+	o := &optionalInt{}
+	flag.Var(o, name, usage)
+	return o
+}
 
-		var err error
-		if *directoryOnly {
-			err = filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
-				if info == nil {
-					return err
-				}
-				name := info.Name()
-				if info.IsDir() && name != "." {
-					if ignorere.MatchString(name) {
-						return filepath.SkipDir
-					}
-					return processMatch(path, info)
-				}
-				return nil
-			})
-		} else {
-			err = filepath.Walk(base, func(path string, info os.FileInfo, err error) error {
-				if info == nil {
-					return err
-				}
-				name := info.Name()
-				if !info.IsDir() {
-					if ignorere.MatchString(name) {
-						return nil
-					}
-					return processMatch(path, info)
-				} else {
-					if ignorere.MatchString(name) {
-						return filepath.SkipDir
-					}
-				}
-				return nil
-			})
-		}
+// regexpList is a flag which may be given more than once, collecting the
+// compiled patterns.
+type regexpList []*regexp.Regexp
 
-		if err != nil && err != maxError {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		}
+func (l *regexpList) String() string {
+	if l == nil {
+		return ""
+	}
+	ss := make([]string, len(*l))
+	for i, re := range *l {
+		ss[i] = re.String()
+	}
+	return strings.Join(ss, ", ")
+}
 
-		close(q)
-	}()
+func (l *regexpList) Set(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, re)
+	return nil
+}
 
-	return q
+func regexpListFlag(name, usage string) *regexpList {
+	l := &regexpList{}
+	flag.Var(l, name, usage)
+	return l
 }
 
-func filesAsync(base string) chan string {
-	wg := new(sync.WaitGroup)
+// stringList is a flag which may be given more than once.
+type stringList []string
 
-	runtime.GOMAXPROCS(runtime.NumCPU())
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ", ")
+}
 
-	q := make(chan string, 20)
-	n := int64(0)
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
 
-	var ferr error
-	var fn func(p string)
-	fn = func(p string) {
-		defer wg.Done()
+func stringListFlag(name, usage string) *stringList {
+	l := &stringList{}
+	flag.Var(l, name, usage)
+	return l
+}
 
-		f, err := os.Open(p)
-		if err != nil {
-			return
-		}
-		defer f.Close()
+func sizeFlag(name string, value int64, usage string) *byteSize {
+	b := byteSize(value)
+	flag.Var(&b, name, usage)
+	return &b
+}
 
-		fis, err := f.Readdir(-1)
-		if err != nil {
-			return
+func parseSize(s string) (int64, error) {
+	t := strings.TrimSuffix(strings.ToUpper(s), "B")
+	unit := int64(1)
+	if t != "" {
+		switch t[len(t)-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		case 'T':
+			unit = 1 << 40
 		}
+		if unit > 1 {
+			t = t[:len(t)-1]
+		}
+	}
+	n, err := strconv.ParseInt(t, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * unit, nil
+}
 
-		processMatch := func(p string, fi os.FileInfo) error {
-			n++
-			// This is pseudo handling because this is not atomic
-			if n > maxcount {
-				return maxError
-			}
-			if *progress {
-				if n%10 == 0 {
-					fmt.Fprintf(os.Stderr, "\r%d            \r", n)
-				}
-			}
-			q <- filepath.ToSlash(filepath.Join(p, fi.Name()))
+func env(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
 
-			return nil
+// allow restricts results to the given paths. Multiple lists intersect.
+func allow(files map[string]bool) {
+	if *ignoreCase {
+		folded := make(map[string]bool, len(files))
+		for f := range files {
+			folded[pathKey(f)] = true
 		}
-
-		for _, fi := range fis {
-			if ignorere.MatchString(fi.Name()) {
-				continue
-			}
-			if *directoryOnly {
-				if fi.IsDir() {
-					wg.Add(1)
-					go fn(filepath.Join(p, fi.Name()))
-					if ferr = processMatch(p, fi); ferr != nil {
-						return
-					}
-				}
-			} else {
-				if fi.IsDir() {
-					wg.Add(1)
-					go fn(filepath.Join(p, fi.Name()))
-				} else {
-					if ferr = processMatch(p, fi); ferr != nil {
-						return
-					}
-				}
+		files = folded
+	}
+	if allowlist != nil {
+		for f := range allowlist {
+			if !files[f] {
+				delete(allowlist, f)
 			}
 		}
+		return
 	}
+	allowlist = files
+}
 
-	fi, err := os.Lstat(base)
+type permCheck struct {
+	mask, value uint32
+}
+
+func parsePermCheck(s string) (permCheck, error) {
+	mask, value := "7777", s
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		mask, value = s[:i], s[i+1:]
+	}
+	m, err := strconv.ParseUint(mask, 8, 32)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return permCheck{}, fmt.Errorf("invalid permission mask %q", mask)
 	}
-	if !fi.IsDir() {
-		fmt.Fprintf(os.Stderr, "%q is not a directory")
-		os.Exit(1)
+	v, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return permCheck{}, fmt.Errorf("invalid permission value %q", value)
 	}
+	return permCheck{uint32(m), uint32(v)}, nil
+}
 
-	wg.Add(1)
-	go fn(base)
+type idRange struct {
+	min, max uint32
+}
 
-	go func() {
-		wg.Wait()
-		close(q)
-		if ferr != nil {
-			fmt.Fprintln(os.Stderr, ferr)
+func (r *idRange) contains(id uint32) bool {
+	return r == nil || r.min <= id && id <= r.max
+}
+
+// parseIDRange parses N, N-M or a name resolved with lookup.
+func parseIDRange(s string, lookup func(string) (string, error)) (*idRange, error) {
+	// Names like www-data are not ranges.
+	if i := strings.IndexByte(s, '-'); i > 0 {
+		min, err1 := strconv.ParseUint(s[:i], 10, 32)
+		max, err2 := strconv.ParseUint(s[i+1:], 10, 32)
+		if err1 == nil && err2 == nil {
+			if min > max {
+				return nil, fmt.Errorf("invalid ID range %q", s)
+			}
+			return &idRange{uint32(min), uint32(max)}, nil
 		}
-	}()
-	return q
+	}
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		name, err := lookup(s)
+		if err != nil {
+			return nil, err
+		}
+		if id, err = strconv.ParseUint(name, 10, 32); err != nil {
+			return nil, err
+		}
+	}
+	return &idRange{uint32(id), uint32(id)}, nil
 }
 
-func main() {
-	flag.Parse()
+// unixMode returns the permission bits of m as in chmod(2).
+func unixMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
 
-	var err error
+// modeExceedsMax reports whether mode has permission bits which max does
+// not.
+func modeExceedsMax(mode, max os.FileMode) bool {
+	return mode.Perm()&^max != 0
+}
 
-	if *match != "" {
-		matchre, err = regexp.Compile(*match)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
-		}
+// depth returns the number of path components of path below the base.
+func depth(path string) int {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return 0
 	}
-	ignorere, err = regexp.Compile(*ignore)
+	return strings.Count(rel, string(os.PathSeparator)) + 1
+}
+
+// isHidden reports whether the name of path, or of a directory it is in
+// below root, starts with a dot.
+func isHidden(path string) bool {
+	rel, err := filepath.Rel(root, path)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		rel = path
 	}
-	base := "."
-	if flag.NArg() > 0 {
-		base = filepath.FromSlash(flag.Arg(0))
-		if runtime.GOOS == "windows" && base != "" && base[0] == '~' {
-			base = filepath.Join(os.Getenv("USERPROFILE"), base[1:])
+	for _, name := range strings.Split(rel, string(os.PathSeparator)) {
+		if strings.HasPrefix(name, ".") && name != "." && name != ".." {
+			return true
 		}
 	}
+	return false
+}
 
-	if *maxfiles > 0 {
-		maxcount = *maxfiles
+// openFile opens path to read its content, waiting while too many files
+// are open already. The file must be closed with closeFile.
+func openFile(path string) (*os.File, error) {
+	readSem <- struct{}{}
+	f, err := os.Open(path)
+	if err != nil {
+		<-readSem
 	}
+	return f, err
+}
 
-	left := base
-	if *absolute {
-		if left, err = filepath.Abs(base); err != nil {
-			left = filepath.Dir(left)
-		}
-	} else if !filepath.IsAbs(base) {
-		if cwd, err := os.Getwd(); err == nil {
-			if left, err = filepath.Rel(cwd, base); err == nil {
-				base = left
-			}
+func closeFile(f *os.File) {
+	f.Close()
+	<-readSem
+}
+
+// sampleEntropy returns the entropy of the first 4KB of the file.
+func sampleEntropy(path string) float64 {
+	f, err := openFile(path)
+	if err != nil {
+		return 0
+	}
+	defer closeFile(f)
+	b := make([]byte, 4096)
+	n, _ := io.ReadFull(f, b)
+	return shannonEntropy(b[:n])
+}
+
+// shannonEntropy returns the Shannon entropy of b in bits per byte, from 0
+// for a single repeated byte to 8 for uniformly random data.
+func shannonEntropy(b []byte) float64 {
+	if len(b) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	var e float64
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(b))
+			e -= p * math.Log2(p)
 		}
 	}
+	return e
+}
 
-	var q chan string
+// matchPattern returns the -m pattern anchored as -match-full-path or
+// -match-anchored say.
+func matchPattern(p string) string {
+	if *matchFullPath {
+		return "^(?:" + p + ")$"
+	} else if *matchAnchored {
+		return "^(?:" + p + ")"
+	}
+	return p
+}
 
-	if *async {
-		q = filesAsync(base)
-	} else {
-		q = filesSync(base)
+// ignorePattern returns the -i pattern anchored as -ignore-anchored says.
+func ignorePattern(p string) string {
+	if *ignoreAnchor {
+		return "^(?:" + p + ")"
 	}
+	return p
+}
 
-	printLine := func() func(string) {
-		if *absolute && !filepath.IsAbs(base) {
-			return func(s string) {
-				fmt.Println(filepath.Join(left, s))
+// matches reports whether the entry matches the -m pattern, which is
+// matched against the name, or with -match-anchored or -match-full-path
+// the slash separated path from the base.
+func matches(path, name string) bool {
+	if matchre == nil {
+		return true
+	}
+	if !*matchAnchored && !*matchFullPath {
+		return matchre.MatchString(name)
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		rel = path
+	}
+	return matchre.MatchString(filepath.ToSlash(rel))
+}
+
+// escapesDir reports whether the symlink at path points outside of dir.
+func escapesDir(path, dir string) bool {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return false
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(path), target)
+	}
+	target, err = filepath.Abs(target)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, target)
+	return err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+var scriptExts = map[string]bool{".sh": true, ".py": true, ".pl": true, ".rb": true}
+
+// checkExecutable warns when the file starts with a shebang line but is
+// not executable. Without -shebang, only files with script extensions are
+// read.
+func checkExecutable(path string, info os.FileInfo) {
+	if !fileType(info).IsRegular() || !*shebang && !scriptExts[filepath.Ext(path)] {
+		return
+	}
+	if info.Mode()&0111 != 0 {
+		return
+	}
+	f, err := openFile(path)
+	if err != nil {
+		return
+	}
+	defer closeFile(f)
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(f, b); err == nil && string(b) == "#!" {
+		fmt.Fprintf(os.Stderr, "%q: shebang line but not executable\n", path)
+	}
+}
+
+func isSparse(info os.FileInfo) bool {
+	blocks, ok := fileBlocks(info)
+	return ok && info.Mode().IsRegular() && blocks*512 < info.Size()
+}
+
+func accept(path string, info os.FileInfo) bool {
+	typ := fileType(info)
+	if typ&os.ModeDevice != 0 {
+		if !*devFiles {
+			return false
+		}
+		if typ&os.ModeCharDevice != 0 && *noCharDevs || typ&os.ModeCharDevice == 0 && *noBlockDevs {
+			return false
+		}
+	}
+	if typ&(os.ModeNamedPipe|os.ModeSocket) != 0 && !*specialFiles {
+		return false
+	}
+	if !typ.IsDir() && (*noEmptyExt || *onlyNoExt) {
+		if noExt := filepath.Ext(info.Name()) == ""; noExt && *noEmptyExt || !noExt && *onlyNoExt {
+			return false
+		}
+	}
+	if allowlist != nil && !allowlist[pathKey(path)] {
+		return false
+	}
+	if *hiddenOnly && !isHidden(path) {
+		return false
+	}
+	if *minDepthFiles > 0 && depth(path) < *minDepthFiles {
+		return false
+	}
+	if uidRange != nil || gidRange != nil {
+		if uid, gid, ok := fileOwner(info); ok {
+			if !uidRange.contains(uid) || !gidRange.contains(gid) {
+				return false
 			}
-		} else {
-			return func(s string) {
-				fmt.Println(s)
+		}
+	}
+	if len(permChecks) > 0 {
+		mode := unixMode(info.Mode())
+		for _, c := range permChecks {
+			if mode&c.mask != c.value {
+				return false
 			}
 		}
-	}()
-	if *fsort {
-		fs := []string{}
-		for s := range q {
-			fs = append(fs, s)
+	}
+	if *findGitRepos && !isGitRepo(path) {
+		return false
+	}
+	if maxMode != nil && !modeExceedsMax(info.Mode(), *maxMode) {
+		return false
+	}
+	switch *sparse {
+	case "exclude":
+		if isSparse(info) {
+			return false
 		}
-		sort.Strings(fs)
-		for _, s := range fs {
-			printLine(s)
+	case "only":
+		if !isSparse(info) {
+			return false
 		}
-	} else {
-		for s := range q {
-			printLine(s)
+	}
+	if *minBlocks >= 0 || *maxBlocks >= 0 {
+		if blocks, ok := fileBlocks(info); ok {
+			if *minBlocks >= 0 && blocks < *minBlocks {
+				return false
+			}
+			if *maxBlocks >= 0 && blocks > *maxBlocks {
+				return false
+			}
+		}
+	}
+	if *excludeNewer != "" && info.ModTime().After(newestTime) {
+		return false
+	}
+	if *skipLarger >= 0 && info.Mode().IsRegular() && info.Size() > int64(*skipLarger) {
+		return false
+	}
+	if *nlinksMin >= 0 || *nlinksMax >= 0 {
+		if nlink, ok := fileNlink(path, info); ok {
+			if *nlinksMin >= 0 && int64(nlink) < *nlinksMin {
+				return false
+			}
+			if *nlinksMax >= 0 && int64(nlink) > *nlinksMax {
+				return false
+			}
+		}
+	}
+	if (*encodingCheck || *skipInvalid) && !utf8.ValidString(info.Name()) {
+		if *encodingCheck {
+			fmt.Fprintf(os.Stderr, "%q: invalid UTF-8 file name\n", path)
+		}
+		if *skipInvalid {
+			return false
+		}
+	}
+	if *minNameLen >= 0 || *maxNameLen >= 0 {
+		n := len(info.Name())
+		if *inRunes {
+			n = utf8.RuneCountInString(info.Name())
+		}
+		if *minNameLen >= 0 && n < *minNameLen {
+			return false
+		}
+		if *maxNameLen >= 0 && n > *maxNameLen {
+			return false
+		}
+	}
+	if (*nullByteCheck || *skipNullByte) && strings.IndexByte(info.Name(), 0) >= 0 {
+		if *nullByteCheck {
+			fmt.Fprintf(os.Stderr, "%q: null byte in file name\n", path)
+		}
+		if *skipNullByte {
+			return false
+		}
+	}
+	if linkBase != "" && fileType(info)&os.ModeSymlink != 0 && escapesDir(path, linkBase) {
+		fmt.Fprintf(os.Stderr, "%q: symlink target outside %s\n", path, *linkTargetDir)
+		if *skipEscaping {
+			return false
+		}
+	}
+	if rootAbs != "" && fileType(info)&os.ModeSymlink != 0 && escapesDir(path, rootAbs) {
+		return false
+	}
+	if *checkExecBit {
+		checkExecutable(path, info)
+	}
+	if *minEntropy > 0 && (!typ.IsRegular() || sampleEntropy(path) < *minEntropy) {
+		return false
+	}
+	if *fileHookCmd != "" {
+		if statCache != nil {
+			return statCache.hook(path, *fileHookCmd, fileHook)
+		}
+		return fileHook(path)
+	}
+	return true
+}
+
+// emit sends a matched entry to q, or returns maxError or sizeError once
+// the limits on results are exceeded. The limits are only approximate when
+// walking concurrently.
+func emit(q chan<- string, path string, info os.FileInfo) error {
+	n := atomic.AddInt64(&foundCount, 1)
+	if n > maxcount {
+		return maxError
+	}
+	if *maxTotalSize >= 0 && fileType(info).IsRegular() {
+		if atomic.AddInt64(&totalSize, info.Size()) > int64(*maxTotalSize) {
+			atomic.StoreInt32(&sizeExceeded, 1)
+			return sizeError
+		}
+	}
+	if *progress {
+		if n%10 == 0 {
+			fmt.Fprintf(os.Stderr, "\r%d            \r", n)
+		}
+	}
+	if fileType(info)&os.ModeSymlink != 0 {
+		atomic.AddInt64(&symlinkCount, 1)
+	}
+	q <- filepath.ToSlash(path)
+	return nil
+}
+
+// emitHookPaths runs the -walk-dir-hook command for dir, if any, and emits
+// the paths it prints.
+func emitHookPaths(q chan<- string, dir string) error {
+	if *walkDirHook == "" {
+		return nil
+	}
+	for _, path := range dirHook(dir) {
+		info, err := os.Lstat(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			logWalkError("lstat", path, err)
+			continue
+		}
+		if err := emit(q, path, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// descend reports whether the walk should enter the directory. Mount
+// boundaries met with -no-cross-mount are reported on q.
+func descend(q chan<- string, path string, info os.FileInfo) bool {
+	if *noRecurse || mounts[path] || *findGitRepos && !*recurseRepos && isGitRepo(path) {
+		atomic.AddInt64(&prunedCount, 1)
+		return false
+	}
+	if *noCrossMount && isMountBoundary(path, info) {
+		if mountEvents {
+			q <- dirEvent + "m" + filepath.ToSlash(path)
+		} else {
+			fmt.Fprintf(os.Stderr, "# mount boundary: %s\n", filepath.ToSlash(path))
+		}
+		atomic.AddInt64(&prunedCount, 1)
+		return false
+	}
+	if _, ok := info.(linkedDir); ok && isVisited(path, info) {
+		fmt.Fprintf(os.Stderr, "%q: symlink to a directory already walked, skipped\n", path)
+		atomic.AddInt64(&prunedCount, 1)
+		return false
+	}
+	if *walkDirLimit > 0 && atomic.AddInt64(&dirsEntered, 1) > *walkDirLimit {
+		dirLimitOnce.Do(func() {
+			fmt.Fprintf(os.Stderr, "reached -walk-dir-limit of %d directories\n", *walkDirLimit)
+		})
+		atomic.AddInt64(&prunedCount, 1)
+		return false
+	}
+	return true
+}
+
+// rootDev is the device of root, which -no-cross-mount stays on.
+var (
+	rootDev   uint64
+	rootDevOK bool
+)
+
+// setRoot sets the directory being walked.
+func setRoot(r string) {
+	root = r
+	rootDevOK = false
+	if fi, err := os.Stat(r); err == nil {
+		rootDev, _, rootDevOK = fileID(r, fi)
+	}
+}
+
+// isMountBoundary reports whether the directory is on another device than
+// root.
+func isMountBoundary(path string, info os.FileInfo) bool {
+	if !rootDevOK {
+		return false
+	}
+	dev, _, ok := fileID(path, info)
+	return ok && dev != rootDev
+}
+
+// walkRoots walks each of the directories in turn, sending all the results
+// to a single channel.
+func walkRoots(roots []string) chan string {
+	q := make(chan string, 20)
+	go func() {
+		defer close(q)
+		for _, r := range roots {
+			setRoot(r)
+			var rq chan string
+			if *async {
+				rq = filesAsync(r)
+			} else {
+				rq = filesSync(r)
+			}
+			for s := range rq {
+				q <- s
+			}
+		}
+	}()
+	return q
+}
+
+func readDir(p string) ([]os.FileInfo, error) {
+	atomic.AddInt64(&dirCount, 1)
+	currentDir.Store(p)
+	if watcher != nil {
+		watcher.add(p)
+	}
+
+	if *dirThrottle > 0 {
+		defer time.Sleep(*dirThrottle)
+	}
+	if *statLatency {
+		defer func(start time.Time) {
+			dirLatency.Store(p, time.Since(start))
+		}(time.Now())
+	}
+
+	read := readDirEntries
+	if statCache != nil {
+		read = statCache.readDir
+	}
+	var fis []os.FileInfo
+	var err error
+	if *walkBudget > 0 {
+		fis, err = readDirBudget(p, *walkBudget, read)
+	} else {
+		fis, err = read(p)
+	}
+	if err != nil {
+		logWalkError("readdir", p, err)
+		if os.IsPermission(err) {
+			atomic.AddInt64(&deniedCount, 1)
+		}
+	}
+	if *walkSymDirs {
+		markVisited(p)
+		for i, fi := range fis {
+			if fileType(fi)&os.ModeSymlink == 0 {
+				continue
+			}
+			if st, err := os.Stat(filepath.Join(p, fi.Name())); err == nil && st.IsDir() {
+				fis[i] = linkedDir{st, fi.Name()}
+			}
+		}
+	}
+	if *treeCount {
+		countTree(p, fis)
+	}
+	if *findLargeDirs > 0 {
+		n := 0
+		for _, fi := range fis {
+			if !fi.IsDir() {
+				n++
+			}
+		}
+		if n > *findLargeDirs {
+			fmt.Fprintf(os.Stderr, "large_dir: %s (%d files)\n", p, n)
+		}
+	}
+	return fis, err
+}
+
+var dirLatency sync.Map
+
+// printSlowDirs prints the n directories which took longest to read.
+func printSlowDirs(w io.Writer, n int) {
+	type dirTime struct {
+		dir string
+		d   time.Duration
+	}
+	var dirs []dirTime
+	dirLatency.Range(func(k, v interface{}) bool {
+		dirs = append(dirs, dirTime{k.(string), v.(time.Duration)})
+		return true
+	})
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].d > dirs[j].d
+	})
+	if len(dirs) > n {
+		dirs = dirs[:n]
+	}
+	for _, d := range dirs {
+		fmt.Fprintf(w, "%v\t%s\n", d.d, filepath.ToSlash(d.dir))
+	}
+}
+
+// linkedDir is a symlink to a directory, which -walk-symlink-dirs walks as
+// if it were the directory itself.
+type linkedDir struct {
+	os.FileInfo
+	name string
+}
+
+func (d linkedDir) Name() string { return d.name }
+
+var (
+	visitedMu   sync.Mutex
+	visitedDirs = map[[2]uint64]bool{}
+)
+
+// markVisited records the directory being read, so symlinks leading back
+// to it are not walked again.
+func markVisited(p string) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return
+	}
+	if dev, ino, ok := fileID(p, fi); ok {
+		visitedMu.Lock()
+		visitedDirs[[2]uint64{dev, ino}] = true
+		visitedMu.Unlock()
+	}
+}
+
+// isVisited reports whether the directory has already been read.
+func isVisited(path string, info os.FileInfo) bool {
+	dev, ino, ok := fileID(path, info)
+	if !ok {
+		return false
+	}
+	visitedMu.Lock()
+	defer visitedMu.Unlock()
+	return visitedDirs[[2]uint64{dev, ino}]
+}
+
+// readDirBudget reads the directory with read, giving up with a warning
+// when it takes longer than budget. The read itself can't be interrupted,
+// so it is left to finish in the background.
+func readDirBudget(p string, budget time.Duration, read func(string) ([]os.FileInfo, error)) ([]os.FileInfo, error) {
+	type listing struct {
+		fis []os.FileInfo
+		err error
+	}
+	done := make(chan listing, 1)
+	go func() {
+		var r listing
+		r.fis, r.err = read(p)
+		done <- r
+	}()
+	t := time.NewTimer(budget)
+	defer t.Stop()
+	select {
+	case r := <-done:
+		return r.fis, r.err
+	case <-t.C:
+		err := fmt.Errorf("%s: reading directory took longer than %s", p, budget)
+		fmt.Fprintf(os.Stderr, "%v, skipped\n", err)
+		return nil, err
+	}
+}
+
+func countTree(p string, fis []os.FileInfo) {
+	for _, fi := range fis {
+		if ignoreMatch(filepath.Join(p, fi.Name()), fi.IsDir()) {
+			continue
+		}
+		switch typ := fileType(fi); {
+		case typ.IsRegular():
+			atomic.AddInt64(&treeCounts[0], 1)
+		case typ.IsDir():
+			atomic.AddInt64(&treeCounts[1], 1)
+		case typ&os.ModeSymlink != 0:
+			atomic.AddInt64(&treeCounts[2], 1)
+		default:
+			atomic.AddInt64(&treeCounts[3], 1)
+		}
+	}
+}
+
+func readDirEntries(p string) ([]os.FileInfo, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if *statFields == "full" {
+		var fis []os.FileInfo
+		for {
+			batch, err := f.Readdir(*readDirBatch)
+			fis = append(fis, batch...)
+			if err == io.EOF {
+				return fis, nil
+			} else if err != nil || *readDirBatch <= 0 {
+				return fis, err
+			}
+		}
+	}
+	var des []os.DirEntry
+	for {
+		batch, err := f.ReadDir(*readDirBatch)
+		des = append(des, batch...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		} else if *readDirBatch <= 0 {
+			break
+		}
+	}
+	fis := make([]os.FileInfo, len(des))
+	for i, de := range des {
+		fi := &lazyInfo{DirEntry: de}
+		if *statFields == "basic" && de.Type().IsRegular() {
+			fi.stat()
+		}
+		fis[i] = fi
+	}
+	return fis, nil
+}
+
+// fileType returns the type bits of info without stat'ing lazy entries.
+func fileType(info os.FileInfo) os.FileMode {
+	if l, ok := info.(*lazyInfo); ok {
+		return l.Type()
+	}
+	return info.Mode().Type()
+}
+
+// lazyInfo is an os.FileInfo which stats the entry on first access to
+// fields that the directory entry does not carry.
+type lazyInfo struct {
+	os.DirEntry
+	fi   os.FileInfo
+	done bool
+}
+
+func (l *lazyInfo) stat() os.FileInfo {
+	if !l.done {
+		l.fi, _ = l.DirEntry.Info()
+		l.done = true
+	}
+	return l.fi
+}
+
+func (l *lazyInfo) Mode() os.FileMode {
+	if fi := l.stat(); fi != nil {
+		return fi.Mode()
+	}
+	return l.Type()
+}
+
+func (l *lazyInfo) Size() int64 {
+	if fi := l.stat(); fi != nil {
+		return fi.Size()
+	}
+	return 0
+}
+
+func (l *lazyInfo) ModTime() time.Time {
+	if fi := l.stat(); fi != nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+func (l *lazyInfo) Sys() interface{} {
+	if fi := l.stat(); fi != nil {
+		return fi.Sys()
+	}
+	return nil
+}
+
+// dirEvent starts the -emit-dir-metadata markers sent along with the paths,
+// which can't contain a NUL.
+const dirEvent = "\x00"
+
+// mapPaths replaces each path from q with the result of fn, dropping the
+// path when fn returns false.
+func mapPaths(q chan string, fn func(s string) (string, bool)) chan string {
+	r := make(chan string, cap(q))
+	go func() {
+		defer close(r)
+		for s := range q {
+			if strings.HasPrefix(s, dirEvent) {
+				r <- s
+				continue
+			}
+			if s, ok := fn(s); ok {
+				r <- s
+			}
+		}
+	}()
+	return r
+}
+
+// resolveTarget returns the real path of s, resolving all symlinks.
+func resolveTarget(s string) (string, bool) {
+	p, err := evalSymlinks(filepath.FromSlash(s), *maxLinkDepth)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintln(os.Stderr, err)
+		} else if *brokenLinks {
+			fmt.Fprintf(os.Stderr, "%q: broken symlink\n", s)
+		}
+		return s, !*skipBroken
+	}
+	return filepath.ToSlash(p), true
+}
+
+// realPathFunc returns a function which makes s absolute and resolves the
+// symlinks in its directory, but not s itself. With cache, the resolved
+// directories are remembered.
+func realPathFunc(cache bool) func(s string) (string, bool) {
+	dirs := map[string]string{}
+	return func(s string) (string, bool) {
+		dir, name := filepath.Split(filepath.FromSlash(s))
+		real, ok := dirs[dir]
+		if !ok {
+			p, err := filepath.Abs(dir)
+			if err == nil {
+				p, err = evalSymlinks(p, *maxLinkDepth)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return s, true
+			}
+			real = p
+			if cache {
+				dirs[dir] = real
+			}
+		}
+		return filepath.ToSlash(filepath.Join(real, name)), true
+	}
+}
+
+// symlinkChain returns path followed by each symlink target in turn, up to
+// max links, ending with "(cycle detected)" when a target repeats.
+func symlinkChain(path string, max int) []string {
+	chain := []string{filepath.ToSlash(path)}
+	seen := map[string]bool{filepath.Clean(path): true}
+	for i := 0; i < max; i++ {
+		fi, err := os.Lstat(path)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			break
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			break
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		chain = append(chain, filepath.ToSlash(target))
+		if seen[target] {
+			chain = append(chain, "(cycle detected)")
+			break
+		}
+		seen[target] = true
+		path = target
+	}
+	return chain
+}
+
+// evalSymlinks is like filepath.EvalSymlinks, but fails after following
+// more than max symlinks. Relative paths resolving below the working
+// directory stay relative.
+func evalSymlinks(path string, max int) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	sep := string(filepath.Separator)
+	dest := filepath.VolumeName(abs) + sep
+	rest := abs[len(dest):]
+	links := 0
+	for rest != "" {
+		var name string
+		if i := strings.Index(rest, sep); i >= 0 {
+			name, rest = rest[:i], rest[i+1:]
+		} else {
+			name, rest = rest, ""
+		}
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			dest = filepath.Dir(dest)
+			continue
+		}
+		next := filepath.Join(dest, name)
+		fi, err := os.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			dest = next
+			continue
+		}
+		links++
+		if links > max {
+			return "", fmt.Errorf("%s: more than %d levels of symlinks", path, max)
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			vol := filepath.VolumeName(target)
+			dest = vol + sep
+			target = target[len(vol):]
+		}
+		rest = target + sep + rest
+	}
+	if !filepath.IsAbs(path) {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, dest); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+sep) {
+				return rel, nil
+			}
+		}
+	}
+	return dest, nil
+}
+
+func filesSync(base string) chan string {
+	fi, err := os.Stat(base)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if !fi.IsDir() {
+		fmt.Fprintf(os.Stderr, "%q is not a directory\n", base)
+		os.Exit(1)
+	}
+
+	q := make(chan string, 20)
+
+	go func() {
+		pinWalkThread()
+		processMatch := func(path string, info os.FileInfo) error {
+			if !matches(path, info.Name()) {
+				return nil
+			}
+			if !accept(path, info) {
+				return nil
+			}
+
+			return emit(q, path, info)
+		}
+
+		// With -level-order, subdirectories are queued and walked after
+		// all the entries of the current level.
+		var queue []pendingDir
+
+		var walk func(p string, scoped []*regexp.Regexp) error
+		walk = func(p string, scoped []*regexp.Regexp) error {
+			if err := emitHookPaths(q, p); err != nil {
+				return err
+			}
+			fis, err := readDir(p)
+			if err != nil {
+				return nil
+			}
+			if *dirMetadata {
+				found := atomic.LoadInt64(&foundCount)
+				q <- dirEvent + "s" + filepath.ToSlash(p)
+				defer func() {
+					n := atomic.LoadInt64(&foundCount) - found
+					q <- dirEvent + "e" + strconv.FormatInt(n, 10) + dirEvent + filepath.ToSlash(p)
+				}()
+			}
+			scoped = scopedIgnores(p, scoped)
+			sort.Slice(fis, func(i, j int) bool {
+				return fis[i].Name() < fis[j].Name()
+			})
+			// Depth-first, the subdirectories of the directories being
+			// walked wait for their turn, and are counted as queued until
+			// it comes.
+			if !*levelOrder {
+				var pending int64
+				for _, fi := range fis {
+					if fi.IsDir() {
+						pending++
+					}
+				}
+				atomic.AddInt64(&queueDepth, pending)
+			}
+
+			// With -reverse-depth, the entries of a directory are emitted
+			// after everything below its subdirectories.
+			var later []os.FileInfo
+			for _, fi := range fis {
+				name := fi.Name()
+				path := filepath.Join(p, name)
+				if fi.IsDir() {
+					if !*levelOrder {
+						atomic.AddInt64(&queueDepth, -1)
+					}
+					if isIgnored(path, fi.IsDir(), scoped) {
+						continue
+					}
+					if *directoryOnly && !*reverseDepth {
+						if err := processMatch(path, fi); err != nil {
+							return err
+						}
+					}
+					if descend(q, path, fi) {
+						if *levelOrder {
+							queue = append(queue, pendingDir{path, scoped})
+							atomic.AddInt64(&queueDepth, 1)
+						} else if err := walk(path, scoped); err != nil {
+							return err
+						}
+					}
+					if *directoryOnly && *reverseDepth {
+						later = append(later, fi)
+					}
+				} else if !*directoryOnly {
+					if isIgnored(path, fi.IsDir(), scoped) {
+						continue
+					}
+					if *reverseDepth {
+						later = append(later, fi)
+						continue
+					}
+					if err := processMatch(path, fi); err != nil {
+						return err
+					}
+				}
+			}
+			for _, fi := range later {
+				if err := processMatch(filepath.Join(p, fi.Name()), fi); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		err := walk(base, nil)
+		for err == nil && len(queue) > 0 {
+			d := queue[0]
+			queue = queue[1:]
+			atomic.AddInt64(&queueDepth, -1)
+			err = walk(d.path, d.scoped)
+		}
+		if err != nil && err != maxError && err != sizeError {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		close(q)
+	}()
+
+	return q
+}
+
+// hasIgnoredName reports whether any name in path below base matches the
+// ignore pattern.
+func hasIgnoredName(base, path string) bool {
+	rel, err := filepath.Rel(base, path)
+	if err != nil {
+		return false
+	}
+	names := strings.Split(rel, string(os.PathSeparator))
+	for i := range names {
+		p := filepath.Join(base, filepath.Join(names[:i+1]...))
+		if ignoreMatch(p, i < len(names)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+// filesList displays the given paths instead of walking base, applying the
+// same filters as the walk.
+func filesList(base string, paths []string) chan string {
+	q := make(chan string, 20)
+
+	go func() {
+		for _, path := range paths {
+			if hasIgnoredName(base, path) {
+				continue
+			}
+			fi, err := os.Lstat(path)
+			if err != nil || fi.IsDir() != *directoryOnly {
+				continue
+			}
+			if !matches(path, fi.Name()) {
+				continue
+			}
+			if !accept(path, fi) {
+				continue
+			}
+			if emit(q, path, fi) != nil {
+				break
+			}
+		}
+		close(q)
+	}()
+
+	return q
+}
+
+// pinWalkThread keeps the calling goroutine on the CPUs of the
+// -walk-io-affinity NUMA node.
+func pinWalkThread() {
+	if walkCPUs == nil {
+		return
+	}
+	if err := pinThread(walkCPUs); err != nil {
+		fmt.Fprintf(os.Stderr, "-walk-io-affinity: %v\n", err)
+	}
+}
+
+// dirQueue is an unbounded queue of directories for the pool model of -A,
+// where the workers taking directories from it also add to it.
+type dirQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	dirs   []pendingDir
+	closed bool
+}
+
+type pendingDir struct {
+	path   string
+	scoped []*regexp.Regexp
+}
+
+func newDirQueue() *dirQueue {
+	dq := &dirQueue{}
+	dq.cond = sync.NewCond(&dq.mu)
+	return dq
+}
+
+func (dq *dirQueue) push(path string, scoped []*regexp.Regexp) {
+	dq.mu.Lock()
+	dq.dirs = append(dq.dirs, pendingDir{path, scoped})
+	dq.mu.Unlock()
+	dq.cond.Signal()
+}
+
+// pop waits for a directory, returning false once the queue is closed.
+func (dq *dirQueue) pop() (pendingDir, bool) {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	for len(dq.dirs) == 0 && !dq.closed {
+		dq.cond.Wait()
+	}
+	if len(dq.dirs) == 0 {
+		return pendingDir{}, false
+	}
+	d := dq.dirs[0]
+	dq.dirs = dq.dirs[1:]
+	return d, true
+}
+
+func (dq *dirQueue) close() {
+	dq.mu.Lock()
+	dq.closed = true
+	dq.mu.Unlock()
+	dq.cond.Broadcast()
+}
+
+func filesAsync(base string) chan string {
+	wg := new(sync.WaitGroup)
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	q := make(chan string, 20)
+
+	fdsem := make(chan struct{}, *fdLimit-*fdLimit/2)
+
+	var ferr error
+	var fn func(p string, scoped []*regexp.Regexp)
+
+	// With the pool model, a fixed set of workers takes the directories
+	// from a queue instead of a goroutine being started for each.
+	spawn := func(p string, scoped []*regexp.Regexp) {
+		go fn(p, scoped)
+	}
+	var pool *dirQueue
+	if *walkModel == "pool" {
+		pool = newDirQueue()
+		spawn = pool.push
+		for i := 0; i < runtime.NumCPU(); i++ {
+			go func() {
+				pinWalkThread()
+				for {
+					d, ok := pool.pop()
+					if !ok {
+						return
+					}
+					fn(d.path, d.scoped)
+				}
+			}()
+		}
+	}
+
+	fn = func(p string, scoped []*regexp.Regexp) {
+		defer wg.Done()
+
+		fdsem <- struct{}{}
+		atomic.AddInt64(&queueDepth, -1)
+		if ferr = emitHookPaths(q, p); ferr != nil {
+			<-fdsem
+			return
+		}
+		fis, err := readDir(p)
+		<-fdsem
+		if err != nil {
+			return
+		}
+		scoped = scopedIgnores(p, scoped)
+
+		processMatch := func(p string, fi os.FileInfo) error {
+			if !matches(filepath.Join(p, fi.Name()), fi.Name()) {
+				return nil
+			}
+			if !accept(filepath.Join(p, fi.Name()), fi) {
+				return nil
+			}
+			return emit(q, filepath.Join(p, fi.Name()), fi)
+		}
+
+		// With -preserve-order, entries of this directory are all emitted
+		// before walking into its subdirectories.
+		var subdirs []string
+		if *preserveOrder {
+			sort.Slice(fis, func(i, j int) bool {
+				return fis[i].Name() < fis[j].Name()
+			})
+			defer func() {
+				for _, d := range subdirs {
+					wg.Add(1)
+					atomic.AddInt64(&queueDepth, 1)
+					spawn(d, scoped)
+				}
+			}()
+		}
+		walkInto := func(d string) {
+			if *preserveOrder {
+				subdirs = append(subdirs, d)
+				return
+			}
+			wg.Add(1)
+			atomic.AddInt64(&queueDepth, 1)
+			spawn(d, scoped)
+		}
+
+		for _, fi := range fis {
+			if isIgnored(filepath.Join(p, fi.Name()), fi.IsDir(), scoped) {
+				continue
+			}
+			if *directoryOnly {
+				if fi.IsDir() {
+					if descend(q, filepath.Join(p, fi.Name()), fi) {
+						walkInto(filepath.Join(p, fi.Name()))
+					}
+					if ferr = processMatch(p, fi); ferr != nil {
+						return
+					}
+				}
+			} else {
+				if fi.IsDir() {
+					if descend(q, filepath.Join(p, fi.Name()), fi) {
+						walkInto(filepath.Join(p, fi.Name()))
+					}
+				} else {
+					if ferr = processMatch(p, fi); ferr != nil {
+						return
+					}
+				}
+			}
+		}
+	}
+
+	fi, err := os.Lstat(base)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if !fi.IsDir() {
+		fmt.Fprintf(os.Stderr, "%q is not a directory\n", base)
+		os.Exit(1)
+	}
+
+	wg.Add(1)
+	atomic.AddInt64(&queueDepth, 1)
+	spawn(base, nil)
+
+	go func() {
+		wg.Wait()
+		if pool != nil {
+			pool.close()
+		}
+		close(q)
+		if ferr != nil {
+			fmt.Fprintln(os.Stderr, ferr)
+		}
+	}()
+	return q
+}
+
+func main() {
+	flag.Parse()
+
+	var err error
+
+	if *showVersion {
+		fmt.Println(Version)
+		return
+	}
+	if *checkUpdate {
+		if !*noUpdateCheck {
+			if err := checkForUpdate(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
+	if *listFileFmts {
+		if err := listFormats(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *listTempPats {
+		if err := listTempPatterns(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *match != "" {
+		matchre, err = regexp.Compile(matchPattern(*match))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	ignorere, err = regexp.Compile(ignorePattern(*ignore))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *omitDirs != "" {
+		omitDirNames = map[string]bool{}
+		for _, name := range strings.Split(*omitDirs, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				omitDirNames[name] = true
+			}
+		}
+	}
+	if *ignoreTemp || *tempPatFile != "" {
+		if tempFileRes, err = loadTempPatterns(*tempPatFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	switch *sparse {
+	case "include", "exclude", "only":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid value %q for -sparse\n", *sparse)
+		os.Exit(1)
+	}
+	if *fdLimit < 0 || *fdLimit == 1 {
+		// The walk and the files read for their content need one each.
+		fmt.Fprintf(os.Stderr, "invalid value %d for -fd-limit, it must be at least 2\n", *fdLimit)
+		os.Exit(1)
+	}
+	if *jsonIndent < 0 {
+		fmt.Fprintf(os.Stderr, "invalid value %d for -json-pretty-indent\n", *jsonIndent)
+		os.Exit(1)
+	}
+	switch *agePrecision {
+	case "seconds", "minutes", "hours", "days":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid value %q for -age-precision\n", *agePrecision)
+		os.Exit(1)
+	}
+	if *dirMetadata && (*format != "json" || *async || *levelOrder || *fsort || *stripPrefix) {
+		fmt.Fprintln(os.Stderr, "-emit-dir-metadata needs -format json and can't be used with -A, -level-order, -s or -strip-common-prefix")
+		os.Exit(1)
+	}
+	if *noEmptyExt && *onlyNoExt {
+		fmt.Fprintln(os.Stderr, "-no-empty-extensions and -only-extensionless can't be used together")
+		os.Exit(1)
+	}
+	// In JSON, mount boundaries go along with the paths unless the output
+	// is collected first.
+	mountEvents = *noCrossMount && *format == "json" && !*fsort && !*stripPrefix
+	if _, ok := manifestFormats[*manifestFmt]; !ok {
+		fmt.Fprintf(os.Stderr, "invalid value %q for -output-manifest-format\n", *manifestFmt)
+		os.Exit(1)
+	}
+	if *statsInterval <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid value %v for -walk-stats-interval\n", *statsInterval)
+		os.Exit(1)
+	}
+	switch *walkModel {
+	case "goroutine", "pool":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid value %q for -walk-concurrency-model\n", *walkModel)
+		os.Exit(1)
+	}
+	switch *sizeFormat {
+	case "bytes", "si", "iec":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid value %q for -size-format\n", *sizeFormat)
+		os.Exit(1)
+	}
+	switch *statFields {
+	case "none", "basic", "full":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid value %q for -walk-stat-fields\n", *statFields)
+		os.Exit(1)
+	}
+	if *levelOrder && *async {
+		fmt.Fprintln(os.Stderr, "-level-order can't be used with -A")
+		os.Exit(1)
+	}
+	if *reverseDepth && *async {
+		fmt.Fprintln(os.Stderr, "-reverse-depth can't be used with -A")
+		os.Exit(1)
+	}
+	if *levelOrder && *reverseDepth {
+		fmt.Fprintln(os.Stderr, "-level-order and -reverse-depth can't be used together")
+		os.Exit(1)
+	}
+	// Each of these replaces the listing with output of its own.
+	var modes []string
+	for _, m := range []struct {
+		name string
+		set  bool
+	}{
+		{"-print-extensions", *printExts},
+		{"-walk-test", *walkTest},
+		{"-no-output", *noOutput},
+		{"-watch-ignore-initial", *watchNoInit},
+		{"-print-diff-from", *printDiffFrom != ""},
+		{"-verify", *verifyHashes != ""},
+		{"-split-output", *splitOutput > 0},
+		{"-find-zero-size-dirs", *zeroSizeDirs},
+		{"-print-checksum-tree", *printSumTree},
+		{"-print-hardlink-groups", *linkGroups},
+		{"-count-by-dir", *countByDir},
+		{"-summarize-by-month", *byMonth},
+		{"-aggregate-by-owner", *byOwner},
+	} {
+		if m.set {
+			modes = append(modes, m.name)
+		}
+	}
+	if len(modes) > 1 {
+		fmt.Fprintf(os.Stderr, "%s can't be used together\n", strings.Join(modes, " and "))
+		os.Exit(1)
+	}
+	if *checkPerms != "" {
+		c, err := parsePermCheck(*checkPerms)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		permChecks = append(permChecks, c)
+	}
+	if *checkModeMax != "" {
+		n, err := strconv.ParseUint(*checkModeMax, 8, 32)
+		if err != nil || n > 0777 {
+			fmt.Fprintf(os.Stderr, "invalid value %q for -check-mode-max\n", *checkModeMax)
+			os.Exit(1)
+		}
+		m := os.FileMode(n)
+		maxMode = &m
+	}
+	if *worldWritable {
+		permChecks = append(permChecks, permCheck{0002, 0002})
+	}
+	if *setuid {
+		permChecks = append(permChecks, permCheck{04000, 04000})
+	}
+	if *byOwner && !ownerSupported {
+		fmt.Fprintf(os.Stderr, "-aggregate-by-owner is not supported on %s\n", runtime.GOOS)
+		os.Exit(1)
+	}
+	if (*uidFlag != "" || *gidFlag != "") && !ownerSupported {
+		fmt.Fprintf(os.Stderr, "-uid and -gid are not supported on %s\n", runtime.GOOS)
+	} else {
+		if *uidFlag != "" {
+			uidRange, err = parseIDRange(*uidFlag, func(name string) (string, error) {
+				u, err := user.Lookup(name)
+				if err != nil {
+					return "", err
+				}
+				return u.Uid, nil
+			})
+		}
+		if err == nil && *gidFlag != "" {
+			gidRange, err = parseIDRange(*gidFlag, func(name string) (string, error) {
+				g, err := user.LookupGroup(name)
+				if err != nil {
+					return "", err
+				}
+				return g.Gid, nil
+			})
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *printACL && !xattrSupported {
+		fmt.Fprintf(os.Stderr, "-print-acl is not supported on %s\n", runtime.GOOS)
+		*printACL = false
+	}
+	if *printSELinux && !xattrSupported {
+		fmt.Fprintf(os.Stderr, "-print-selinux is not supported on %s\n", runtime.GOOS)
+		*printSELinux = false
+	}
+	if *excludeNewer != "" {
+		fi, err := os.Stat(*excludeNewer)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		newestTime = fi.ModTime()
+	}
+	if *linkTargetDir != "" {
+		var err error
+		if linkBase, err = filepath.Abs(*linkTargetDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *ioAffinity >= 0 {
+		if !affinitySupported {
+			fmt.Fprintf(os.Stderr, "-walk-io-affinity is not supported on %s\n", runtime.GOOS)
+			os.Exit(1)
+		}
+		if walkCPUs, err = numaCPUs(*ioAffinity); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		*walkModel = "pool"
+	}
+	if *fsWalk && !mountsSupported {
+		fmt.Fprintf(os.Stderr, "-file-system-walk is not supported on %s\n", runtime.GOOS)
+		os.Exit(1)
+	}
+	if *checkExecBit && runtime.GOOS == "windows" {
+		fmt.Fprintf(os.Stderr, "-check-executable-bit is not supported on %s\n", runtime.GOOS)
+		*checkExecBit = false
+	}
+	base := "."
+	if flag.NArg() > 0 {
+		base = filepath.FromSlash(flag.Arg(0))
+		if runtime.GOOS == "windows" && base != "" && base[0] == '~' {
+			base = filepath.Join(os.Getenv("USERPROFILE"), base[1:])
+		}
+	}
+	if *repoRoot {
+		if base, err = findRepoRoot(base, *repoRootType); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if *absSymlink {
+		if base, err = filepath.EvalSymlinks(base); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if *noCrossLink {
+		if rootAbs, err = filepath.Abs(base); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if *findGitRepos {
+		*directoryOnly = true
+	}
+
+	if *maxfiles > 0 {
+		maxcount = *maxfiles
+	}
+	if *fdLimit == 0 {
+		*fdLimit = defaultFdLimit()
+	}
+	// Directories and files read for their content share -fd-limit, each
+	// with a semaphore of its own so one can't starve the other.
+	readSem = make(chan struct{}, *fdLimit/2)
+	if *statCacheFile != "" {
+		statCache = loadDirCache(*statCacheFile)
+	}
+	if *watchNoInit {
+		*inotify = true
+	}
+	if *inotify {
+		if watcher, err = newDirWatcher(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *walkErrsJSON != "" {
+		if walkErrors, err = openErrorLog(*walkErrsJSON, *inotify); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	left := base
+	if *absolute {
+		if left, err = filepath.Abs(base); err != nil {
+			left = filepath.Dir(left)
+		}
+	} else if !filepath.IsAbs(base) {
+		if cwd, err := os.Getwd(); err == nil {
+			if left, err = filepath.Rel(cwd, base); err == nil {
+				base = left
+			}
+		}
+	}
+
+	if !flagGiven("ignore-case-paths") && (runtime.GOOS == "darwin" || runtime.GOOS == "windows") {
+		*ignoreCase = caseInsensitive(base)
+	}
+
+	switch *gitConfigAs {
+	case "ignore", "match":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid value %q for -git-config-as\n", *gitConfigAs)
+		os.Exit(1)
+	}
+	for _, key := range *gitConfigs {
+		v, err := gitConfig(base, key)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if v == "" {
+			continue
+		}
+		if *gitConfigAs == "match" {
+			pattern := matchPattern(v)
+			if matchre != nil {
+				pattern = matchre.String() + "|" + pattern
+			}
+			matchre, err = regexp.Compile(pattern)
+		} else {
+			ignorere, err = regexp.Compile(ignorere.String() + "|" + ignorePattern(v))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", key, err)
+			os.Exit(1)
+		}
+	}
+
+	if *gitTracked {
+		files, err := gitFiles(base, trackedArgs...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		allow(files)
+	}
+	if *onlyModified {
+		files, err := gitFiles(base, "diff", "-z", "--name-only", "--relative", "--diff-filter=M", "HEAD")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		allow(files)
+	}
+	if *onlyStaged {
+		files, err := gitFiles(base, "diff", "-z", "--name-only", "--relative", "--cached", "--diff-filter=d")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		allow(files)
+	}
+	if *gitUntracked {
+		files, err := gitFiles(base, untrackedArgs...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		allow(files)
+	}
+
+	var aw *atomicWriter
+	if *atomicOutput {
+		aw = &atomicWriter{max: int64(*atomicMaxMem)}
+		stdout = aw
+	}
+
+	var oh hash.Hash
+	if *outputHash != "" {
+		newHash, ok := hashAlgos[*outputHash]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "invalid value %q for -output-hash\n", *outputHash)
+			os.Exit(1)
+		}
+		oh = newHash()
+		stdout = io.MultiWriter(stdout, oh)
+	}
+
+	out, err := newFormatter(*format, stdout, !*noHeader)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *parallelOut > 1 && *format != "text" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "-parallel-output is not supported with -format %s\n", *format)
+		*parallelOut = 0
+	}
+	if *parallelOut > 1 && *fileNumber {
+		// The writers would take the line numbers in turn, out of order.
+		fmt.Fprintln(os.Stderr, "-parallel-output is not supported with -n")
+		*parallelOut = 0
+	}
+
+	if *printBase {
+		b := base
+		if *absolute {
+			b = left
+		}
+		if *format == "json" {
+			printJSONLine(struct {
+				Type string `json:"type"`
+				Path string `json:"path"`
+			}{"base", filepath.ToSlash(b)})
+		} else {
+			fmt.Fprintf(stdout, "# base: %s\n", filepath.ToSlash(b))
+		}
+	}
+
+	var stopProgress func()
+	if *progressFile != "" {
+		stopProgress = startProgressFile(*progressFile, time.Second, func(start time.Time) interface{} {
+			return currentProgress(start)
+		})
+	}
+	var stopWalkStats func()
+	if *walkStatsFile != "" {
+		stopWalkStats = startProgressFile(*walkStatsFile, *statsInterval, currentWalkStats)
+	}
+	var stopProgressSocket func()
+	if *progressJSON != "" {
+		if stopProgressSocket, err = startProgressSocket(*progressJSON, time.Second); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	var stopQueueDepth func()
+	if *showQueueLen {
+		stopQueueDepth = startQueueDepth(time.Second)
+	}
+	var stopMetrics func()
+	if *metricPort > 0 {
+		if stopMetrics, err = startMetrics(*metricPort); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	setRoot(base)
+	var q chan string
+
+	if fromGitStash.set {
+		paths, err := gitPaths(base, "stash", "show", "-z", "--name-only", "--relative", fmt.Sprintf("stash@{%d}", fromGitStash.n))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		q = filesList(base, paths)
+	} else if *sinceCommit != "" || *sinceTag != "" {
+		rev := *sinceCommit
+		if rev == "" {
+			rev = "refs/tags/" + *sinceTag
+		}
+		if err := gitVerifyCommit(base, rev); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		paths, err := gitPaths(base, "diff", "-z", "--name-only", "--relative", "--diff-filter=d", rev, "HEAD")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		q = filesList(base, paths)
+	} else if *queryIndex != "" {
+		h, entries, err := loadIndex(*queryIndex)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		q = filesIndex(h.Base, entries)
+	} else if *fsWalk {
+		var roots []string
+		if mounts, roots, err = mountPoints(*localOnly); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		q = walkRoots(roots)
+	} else if *async {
+		q = filesAsync(base)
+	} else {
+		q = filesSync(base)
+	}
+	var index *indexWriter
+	if *createIndex != "" {
+		index = &indexWriter{base: base}
+		q = mapPaths(q, func(s string) (string, bool) {
+			index.add(s)
+			return s, true
+		})
+	}
+	if *targetOnly {
+		q = mapPaths(q, resolveTarget)
+	} else if *printRealpath || *realpathCache {
+		q = mapPaths(q, realPathFunc(*realpathCache))
+	}
+
+	display := func() func(string) string {
+		if *absolute && !filepath.IsAbs(base) {
+			return func(s string) string {
+				if filepath.IsAbs(s) {
+					return s
+				}
+				if rel, err := filepath.Rel(base, filepath.FromSlash(s)); err == nil {
+					s = rel
+				}
+				return filepath.Join(left, s)
+			}
+		} else {
+			return func(s string) string {
+				return s
+			}
+		}
+	}()
+	if *pathComps > 0 {
+		show := display
+		display = func(s string) string {
+			return lastComponents(show(s), *pathComps)
+		}
+	}
+	if len(*omitPatterns) > 0 {
+		q = mapPaths(q, func(s string) (string, bool) {
+			return s, !omitted(display(s))
+		})
+	}
+	invalid := false
+	if *validateOut || *validateExit {
+		q = mapPaths(q, func(s string) (string, bool) {
+			if _, err := os.Lstat(filepath.FromSlash(s)); err != nil {
+				fmt.Fprintf(os.Stderr, "%v, skipped\n", err)
+				invalid = true
+				return s, false
+			}
+			return s, true
+		})
+	}
+	var manifest []string
+	if *writeManif != "" {
+		q = mapPaths(q, func(s string) (string, bool) {
+			manifest = append(manifest, filepath.ToSlash(display(s)))
+			return s, true
+		})
+	}
+	total := 0
+	path := func(r *result) interface{} {
+		return display(r.path)
+	}
+	if *printType && *format != "json" {
+		path = func(r *result) interface{} {
+			return display(r.path) + typeIndicator(r.info())
+		}
+	}
+	if *printIndent {
+		path = func(r *result) interface{} {
+			depth := 0
+			if rel, err := filepath.Rel(base, filepath.FromSlash(r.path)); err == nil {
+				depth = strings.Count(filepath.ToSlash(rel), "/")
+			}
+			name := strings.Repeat(*indentString, depth) + filepath.Base(r.path)
+			if *printType && *format != "json" {
+				name += typeIndicator(r.info())
+			}
+			return name
+		}
+	}
+	if *pathSep != "" {
+		show := path
+		path = func(r *result) interface{} {
+			return withPathSep(fieldString(show(r)), *pathSep)
+		}
+	}
+	pathHash := func(r *result) interface{} {
+		return hashPath(display(r.path), *salt)
+	}
+	var cols []column
+	if *columns != "" {
+		pathCols := map[string]func(r *result) interface{}{"PATH": path, "PATH_HASH": pathHash}
+		if cols, err = parseColumns(*columns, pathCols); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else {
+		cols = []column{{"PATH", path}}
+		if *printSHA {
+			cols[0] = column{"PATH_HASH", pathHash}
+		}
+		if *printLinks {
+			cols = append([]column{{"NLINKS", columnDefs["NLINKS"]}}, cols...)
+		}
+		if *printDevice {
+			if *format == "json" {
+				cols = append([]column{{"DEVICE", columnDefs["DEVICE"]}, {"DEVICE_MAJOR", columnDefs["DEVICE_MAJOR"]}, {"DEVICE_MINOR", columnDefs["DEVICE_MINOR"]}}, cols...)
+			} else {
+				cols = append([]column{{"DEVICE", columnDefs["DEVICE"]}}, cols...)
+			}
+		}
+		if *printAge {
+			cols = append([]column{{"AGE", columnDefs["AGE"]}}, cols...)
+		}
+		if *devFiles && *format == "json" {
+			for _, name := range []string{"DEVICE_TYPE", "RDEV_MAJOR", "RDEV_MINOR"} {
+				cols = append(cols, column{name, columnDefs[name]})
+			}
+		}
+		if *printACL {
+			cols = append(cols, column{"ACL", columnDefs["ACL"]})
+		}
+		if *previewBytes > 0 {
+			cols = append(cols, column{"PREVIEW", columnDefs["PREVIEW"]})
+		}
+		if *printSELinux {
+			cols = append(cols, column{"SELINUX_CONTEXT", columnDefs["SELINUX_CONTEXT"]})
+		}
+	}
+	if *printChain {
+		if *format == "json" {
+			cols = append(cols, column{"SYMLINK_CHAIN", columnDefs["SYMLINK_CHAIN"]})
+		} else {
+			first := cols[0].value
+			cols[0].value = func(r *result) interface{} {
+				chain, _ := columnDefs["SYMLINK_CHAIN"](r).([]string)
+				if chain == nil {
+					return first(r)
+				}
+				s := fieldString(first(r))
+				for _, p := range chain[1:] {
+					if p == "(cycle detected)" {
+						s += " " + p
+					} else {
+						s += " -> " + p
+					}
+				}
+				return s
+			}
+		}
+	}
+	if *encodingCheck && *format == "json" {
+		// encoding/json replaces invalid UTF-8 with U+FFFD, so this tells
+		// which paths aren't the names on disk.
+		cols = append(cols, column{"ENCODING_WARNING", func(r *result) interface{} {
+			return !utf8.ValidString(r.path)
+		}})
+	}
+	if *printGitRoot {
+		if *format == "text" {
+			first := cols[0].value
+			cols[0].value = func(r *result) interface{} {
+				return fieldString(columnDefs["GIT_ROOT"](r)) + ":" + fieldString(first(r))
+			}
+		} else {
+			cols = append([]column{{"GIT_ROOT", columnDefs["GIT_ROOT"]}}, cols...)
+		}
+	}
+	if *fileNumber {
+		var line int64
+		number := func(r *result) interface{} {
+			return atomic.AddInt64(&line, 1)
+		}
+		if *format == "text" {
+			first := cols[0].value
+			cols[0].value = func(r *result) interface{} {
+				return fmt.Sprintf("%d%s%s", number(r), *fileNumberSep, fieldString(first(r)))
+			}
+		} else {
+			cols = append([]column{{"LINE_NUMBER", number}}, cols...)
+		}
+	}
+	names := make([]string, len(cols))
+	for i, c := range cols {
+		names[i] = c.name
+	}
+	row := func(s string) []interface{} {
+		r := &result{path: s}
+		fields := make([]interface{}, len(cols))
+		for i, c := range cols {
+			fields[i] = c.value(r)
+		}
+		return fields
+	}
+	printLine := func(s string) {
+		total++
+		out.write(names, row(s))
+	}
+	// customPrint is set when printLine is replaced by another output mode,
+	// which -parallel-output can't take over.
+	customPrint := false
+	exts := map[string]int{}
+	if *printExts {
+		customPrint = true
+		printLine = func(s string) {
+			total++
+			if ext := extKey(s); ext != "" {
+				exts[ext]++
+			}
+		}
+	}
+	if *walkTest || *noOutput || *watchNoInit {
+		customPrint = true
+		printLine = func(s string) {
+			total++
+		}
+	}
+	var diff *pathDiff
+	if *printDiffFrom != "" {
+		list, err := readPathList(*printDiffFrom)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		diff = newPathDiff(list)
+		customPrint = true
+		printLine = func(s string) {
+			total++
+			fmt.Fprintln(stdout, diff.mark(display(s)))
+		}
+	}
+	var hashes map[string]bool
+	changed := false
+	if *verifyHashes != "" {
+		hashes, err = readPathList(*verifyHashes)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		customPrint = true
+		printLine = func(s string) {
+			total++
+			h := hashPath(display(s), *salt)
+			if hashes[h] {
+				delete(hashes, h)
+			} else {
+				fmt.Fprintln(stdout, "+"+h)
+				changed = true
+			}
+		}
+	}
+	var split *splitWriter
+	if *splitOutput > 0 {
+		if split, err = newSplitWriter(*splitPrefix, *splitOutput, *format, !*noHeader, *splitByHash); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		customPrint = true
+		printLine = func(s string) {
+			total++
+			if err := split.write(display(s), names, row(s)); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}
+	var sizedDirs map[string][2]int
+	if *zeroSizeDirs {
+		sizedDirs = map[string][2]int{}
+		customPrint = true
+		printLine = func(s string) {
+			total++
+			fi, err := os.Lstat(filepath.FromSlash(s))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			if !fi.Mode().IsRegular() {
+				return
+			}
+			for d := filepath.Dir(filepath.FromSlash(s)); d != base && d != filepath.Dir(d); d = filepath.Dir(d) {
+				c := sizedDirs[d]
+				c[0]++
+				if fi.Size() > 0 {
+					c[1]++
+				}
+				sizedDirs[d] = c
+			}
+		}
+	}
+	var tree *checksumTree
+	if *printSumTree {
+		tree = newChecksumTree(filepath.ToSlash(base))
+		customPrint = true
+		printLine = func(s string) {
+			total++
+			fi, err := os.Lstat(filepath.FromSlash(s))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			tree.add(s, fi)
+		}
+	}
+	var groups []*linkGroup
+	if *linkGroups {
+		byID := map[[2]uint64]*linkGroup{}
+		customPrint = true
+		printLine = func(s string) {
+			total++
+			p := display(s)
+			var dev, ino uint64
+			ok := false
+			if fi, err := os.Lstat(filepath.FromSlash(s)); err == nil {
+				dev, ino, ok = fileID(filepath.FromSlash(s), fi)
+			}
+			if ok {
+				if g := byID[[2]uint64{dev, ino}]; g != nil {
+					g.Paths = append(g.Paths, p)
+					return
+				}
+			}
+			g := &linkGroup{Inode: ino, Paths: []string{p}}
+			groups = append(groups, g)
+			if ok {
+				byID[[2]uint64{dev, ino}] = g
+			}
+		}
+	}
+	dirs := map[string]int{}
+	if *countByDir {
+		customPrint = true
+		printLine = func(s string) {
+			total++
+			dirs[filepath.Dir(display(s))]++
+		}
+	}
+	months := map[string][2]int64{}
+	if *byMonth {
+		customPrint = true
+		printLine = func(s string) {
+			total++
+			fi, err := os.Lstat(filepath.FromSlash(s))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			m := fi.ModTime().Format("2006-01")
+			months[m] = [2]int64{months[m][0] + 1, months[m][1] + fi.Size()}
+		}
+	}
+	if *dirMetadata || mountEvents {
+		customPrint = true
+		printPath := printLine
+		printLine = func(s string) {
+			if !strings.HasPrefix(s, dirEvent) {
+				printPath(s)
+				return
+			}
+			switch s = s[len(dirEvent):]; s[0] {
+			case 's':
+				var mtime interface{}
+				if fi, err := os.Lstat(filepath.FromSlash(s[1:])); err == nil {
+					mtime = fi.ModTime().Format(time.RFC3339)
+				}
+				out.write([]string{"TYPE", "PATH", "MTIME"}, []interface{}{"dir_start", display(s[1:]), mtime})
+			case 'e':
+				i := strings.Index(s, dirEvent)
+				n, _ := strconv.ParseInt(s[1:i], 10, 64)
+				out.write([]string{"TYPE", "PATH", "FILE_COUNT"}, []interface{}{"dir_end", display(s[i+len(dirEvent):]), n})
+			case 'm':
+				out.write([]string{"TYPE", "PATH"}, []interface{}{"mount_boundary", display(s[1:])})
+			}
+		}
+	}
+	owners := map[uint32][2]int64{}
+	if *byOwner {
+		customPrint = true
+		printLine = func(s string) {
+			total++
+			fi, err := os.Lstat(filepath.FromSlash(s))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			if uid, _, ok := fileOwner(fi); ok {
+				owners[uid] = [2]int64{owners[uid][0] + 1, owners[uid][1] + fi.Size()}
+			}
+		}
+	}
+	if *fsort || *stripPrefix {
+		fs := []string{}
+		for s := range q {
+			fs = append(fs, s)
+		}
+		if *fsort {
+			sort.Strings(fs)
+		}
+		if *stripPrefix {
+			show := display
+			prefix := commonDir(fs, show)
+			display = func(s string) string {
+				// The prefix is slash separated, but has the same length.
+				return show(s)[len(prefix):]
+			}
+		}
+		for _, s := range fs {
+			printLine(s)
+		}
+	} else if *parallelOut > 1 && !customPrint {
+		n, err := parallelWrite(q, *parallelOut, stdout, *format, row, names)
+		total += n
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	} else {
+		for s := range q {
+			printLine(s)
+		}
+	}
+
+	if err := out.flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if stopProgress != nil {
+		stopProgress()
+	}
+	if stopProgressSocket != nil {
+		stopProgressSocket()
+	}
+	if stopWalkStats != nil {
+		stopWalkStats()
+	}
+	if stopQueueDepth != nil {
+		stopQueueDepth()
+	}
+	if stopMetrics != nil {
+		stopMetrics()
+	}
+	if walkErrors != nil && !walkErrors.stream {
+		if err := walkErrors.close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if *printExts {
+		printExtensions(exts, *format == "json")
+	}
+	if *countByDir {
+		printDirCounts(dirs, *format == "json")
+	}
+	if *byMonth {
+		printMonths(months, *format == "json")
+	}
+	if *byOwner {
+		printOwners(owners, *format == "json")
+	}
+	if split != nil {
+		if err := split.close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if sizedDirs != nil {
+		dirs := make([]string, 0, len(sizedDirs))
+		for d, c := range sizedDirs {
+			if c[1] < *minNonzero {
+				dirs = append(dirs, d)
+			}
+		}
+		sort.Strings(dirs)
+		for _, d := range dirs {
+			fmt.Fprintln(stdout, display(filepath.ToSlash(d)))
+		}
+	}
+	if tree != nil {
+		if err := tree.print(stdout, display); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if *linkGroups {
+		printLinkGroups(groups, *format == "json")
+	}
+	if hashes != nil {
+		missing := make([]string, 0, len(hashes))
+		for h := range hashes {
+			missing = append(missing, h)
+		}
+		sort.Strings(missing)
+		for _, h := range missing {
+			fmt.Fprintln(stdout, "-"+h)
+			changed = true
+		}
+	}
+	if diff != nil {
+		for _, s := range diff.missing() {
+			fmt.Fprintln(stdout, "-"+s)
+		}
+	}
+	if *walkTest {
+		fmt.Fprintf(stdout, "%d files would be matched, %d entries were ignored, %d directories were pruned\n",
+			total, atomic.LoadInt64(&ignoredCount), atomic.LoadInt64(&prunedCount))
+	}
+
+	if *statLatency {
+		printSlowDirs(os.Stderr, 10)
+	}
+	if *reportDenied {
+		if *format == "json" {
+			fmt.Fprintf(os.Stderr, "{\"inaccessible_dirs\":%d}\n", atomic.LoadInt64(&deniedCount))
+		} else {
+			fmt.Fprintf(os.Stderr, "inaccessible_dirs: %d\n", atomic.LoadInt64(&deniedCount))
+		}
+	}
+
+	if statCache != nil {
+		if err := statCache.save(*statCacheFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if index != nil {
+		if err := index.save(*createIndex); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if *writeManif != "" {
+		if err := writeManifest(*writeManif, *manifestFmt, *manifestVar, manifest); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	printTrailers(int64(total), oh)
+
+	if aw != nil {
+		if err := aw.flush(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if atomic.LoadInt32(&sizeExceeded) != 0 {
+		os.Exit(2)
+	}
+	if changed || invalid && *validateExit {
+		os.Exit(1)
+	}
+
+	if watcher != nil {
+		// Each event is written at once with -atomic-output.
+		printEvent := func(s string) {
+			fmt.Fprintln(stdout, s)
+			if aw != nil {
+				aw.flush(os.Stdout)
+			}
+		}
+		err = watcher.run(func(path string, created, isDir bool) {
+			if ignoreMatch(path, isDir) {
+				return
+			}
+			if created && isDir {
+				watchTree(path, func(s string) {
+					printEvent("+" + display(s))
+				})
+			}
+			if isDir != *directoryOnly {
+				return
+			}
+			if !matches(path, filepath.Base(path)) {
+				return
+			}
+			if !created {
+				// A deleted file can't be stat'ed for the other filters.
+				printEvent("-" + display(filepath.ToSlash(path)))
+				return
+			}
+			fi, err := os.Lstat(path)
+			if err != nil || !accept(path, fi) {
+				return
+			}
+			printEvent("+" + display(filepath.ToSlash(path)))
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// linkGroup is the paths found for one file, several when it has hard
+// links in the tree.
+type linkGroup struct {
+	Inode uint64   `json:"inode"`
+	Paths []string `json:"paths"`
+}
+
+func printLinkGroups(groups []*linkGroup, asJSON bool) {
+	for _, g := range groups {
+		sort.Strings(g.Paths)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Paths[0] < groups[j].Paths[0]
+	})
+	if asJSON {
+		b, _ := json.Marshal(groups)
+		fmt.Fprintf(stdout, "%s\n", b)
+		return
+	}
+	for _, g := range groups {
+		fmt.Fprintln(stdout, strings.Join(g.Paths, "\t"))
+	}
+}
+
+// typeIndicator returns the character ls -F appends for the file type.
+func typeIndicator(fi os.FileInfo) string {
+	if fi == nil {
+		return ""
+	}
+	switch mode := fi.Mode(); {
+	case mode.IsDir():
+		return "/"
+	case mode&os.ModeSymlink != 0:
+		return "@"
+	case mode&os.ModeNamedPipe != 0:
+		return "|"
+	case mode&os.ModeSocket != 0:
+		return "="
+	case mode.IsRegular() && mode&0111 != 0:
+		return "*"
+	}
+	return ""
+}
+
+// commonDir returns the longest directory prefix, with the trailing
+// slash, shared by the displayed paths.
+func commonDir(paths []string, display func(string) string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	prefix := filepath.ToSlash(display(paths[0]))
+	prefix = prefix[:strings.LastIndex(prefix, "/")+1]
+	for _, s := range paths[1:] {
+		s = filepath.ToSlash(display(s))
+		for !strings.HasPrefix(s, prefix) {
+			prefix = prefix[:strings.LastIndex(prefix[:len(prefix)-1], "/")+1]
+		}
+		if prefix == "" {
+			break
+		}
+	}
+	return prefix
+}
+
+// readPathList reads the paths in a previous output of files, one per line.
+func readPathList(name string) (map[string]bool, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	paths := map[string]bool{}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line != "" {
+			paths[line] = true
+		}
+	}
+	return paths, nil
+}
+
+// flagGiven reports whether the flag was set on the command line.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// caseInsensitive probes whether the file system of dir ignores case, by
+// looking up an entry of dir under a name with the case swapped.
+func caseInsensitive(dir string) bool {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	names, err := f.Readdirnames(64)
+	f.Close()
+	if err != nil {
+		return false
+	}
+	exists := map[string]bool{}
+	for _, name := range names {
+		exists[name] = true
+	}
+	for _, name := range names {
+		swapped := strings.Map(func(r rune) rune {
+			if unicode.IsUpper(r) {
+				return unicode.ToLower(r)
+			}
+			return unicode.ToUpper(r)
+		}, name)
+		if swapped == name || exists[swapped] {
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		sfi, err := os.Lstat(filepath.Join(dir, swapped))
+		return err == nil && os.SameFile(fi, sfi)
+	}
+	return false
+}
+
+// pathKey returns path folded to lower case with -ignore-case-paths, for
+// comparing paths.
+func pathKey(path string) string {
+	if *ignoreCase {
+		return strings.ToLower(path)
+	}
+	return path
+}
+
+// withPathSep returns path with its components separated by sep, or path
+// unchanged when sep is empty.
+func withPathSep(path, sep string) string {
+	if sep == "" {
+		return path
+	}
+	return strings.ReplaceAll(filepath.ToSlash(path), "/", sep)
+}
+
+// compoundExtensions are the extensions made of more than one part, which
+// -coalesce-extensions counts as a single extension.
+var compoundExtensions = []string{
+	".tar.gz",
+	".tar.bz2",
+	".tar.xz",
+	".tar.zst",
+	".tar.lz4",
+	".tar.lzma",
+}
+
+// fileExt returns the extension of path like filepath.Ext, but with
+// -coalesce-extensions or -compound-ext a compound extension as a whole.
+func fileExt(path string) string {
+	if !*coalesceExts && len(*compoundExts) == 0 {
+		return filepath.Ext(path)
+	}
+	name := filepath.Base(path)
+	for _, ext := range append(compoundExtensions, *compoundExts...) {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if len(name) <= len(ext) {
+			continue
+		}
+		suffix := name[len(name)-len(ext):]
+		if suffix == ext || *extCaseFold && strings.EqualFold(suffix, ext) {
+			return suffix
+		}
+	}
+	return filepath.Ext(path)
+}
+
+// omitted reports whether the displayed path matches an -omit-pattern.
+func omitted(path string) bool {
+	for _, re := range *omitPatterns {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// extKey returns the extension of path counted by -print-extensions,
+// lowercased with -ext-case-fold.
+func extKey(path string) string {
+	ext := fileExt(path)
+	if *extCaseFold {
+		ext = strings.ToLower(ext)
+	}
+	return ext
+}
+
+// lastComponents returns the last n components of path, or the whole path
+// when it has no more than n.
+func lastComponents(path string, n int) string {
+	i := len(path)
+	for ; n > 0; n-- {
+		i = strings.LastIndexAny(path[:i], "/"+string(os.PathSeparator))
+		if i < 0 {
+			return path
+		}
+	}
+	return path[i+1:]
+}
+
+// byCount returns the keys of counts sorted by count descending.
+func byCount(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+func printExtensions(exts map[string]int, asJSON bool) {
+	type extCount struct {
+		Ext   string `json:"ext"`
+		Count int    `json:"count"`
+	}
+	keys := byCount(exts)
+	if asJSON {
+		counts := make([]extCount, len(keys))
+		for i, ext := range keys {
+			counts[i] = extCount{ext, exts[ext]}
+		}
+		printJSONLine(counts)
+		return
+	}
+	for _, ext := range keys {
+		fmt.Fprintf(stdout, "%5d %s\n", exts[ext], ext)
+	}
+}
+
+// printJSONLine writes v to stdout as a line of its own, used for the
+// summaries following the paths in -format json.
+func printJSONLine(v interface{}) {
+	b, _ := json.Marshal(v)
+	fmt.Fprintf(stdout, "%s\n", b)
+}
+
+// printCount writes a "# name: n" trailer, or a {"type": name, "count": n}
+// object in JSON.
+func printCount(name string, n int64, asJSON bool) {
+	if asJSON {
+		printJSONLine(struct {
+			Type  string `json:"type"`
+			Count int64  `json:"count"`
+		}{name, n})
+		return
+	}
+	fmt.Fprintf(stdout, "# %s: %d\n", name, n)
+}
+
+// fdLimitOf returns the default -fd-limit for a limit of n open files,
+// leaving some for the runtime and capping it at 65536.
+func fdLimitOf(n uint64) int {
+	if n > 1<<16 {
+		n = 1 << 16
+	}
+	return int(n) * 9 / 10
+}
+
+// printTrailers writes the trailers which follow the results, in a fixed
+// order: symlinks, tree counts, the output hash and the total last. The
+// hash covers the lines above it.
+func printTrailers(total int64, oh hash.Hash) {
+	asJSON := *format == "json"
+	if *countSymlinks {
+		n := atomic.LoadInt64(&symlinkCount)
+		if asJSON {
+			printJSONLine(struct {
+				Type         string `json:"type"`
+				SymlinkCount int64  `json:"symlink_count"`
+			}{"symlinks", n})
+		} else {
+			printCount("symlinks", n, false)
+		}
+	}
+	if *treeCount {
+		printTreeCounts(asJSON)
+	}
+	if oh != nil {
+		if asJSON {
+			printJSONLine(struct {
+				Type       string `json:"type"`
+				OutputHash string `json:"output_hash"`
+			}{"output_hash", fmt.Sprintf("%s:%x", *outputHash, oh.Sum(nil))})
+		} else {
+			fmt.Fprintf(stdout, "# %s: %x\n", *outputHash, oh.Sum(nil))
+		}
+	}
+	if *printCounts {
+		printCount("total", total, asJSON)
+	}
+}
+
+func printTreeCounts(asJSON bool) {
+	var c [4]int64
+	for i := range c {
+		c[i] = atomic.LoadInt64(&treeCounts[i])
+	}
+	sum := c[0] + c[1] + c[2] + c[3]
+	if asJSON {
+		printJSONLine(struct {
+			Type     string `json:"type"`
+			Files    int64  `json:"files"`
+			Dirs     int64  `json:"dirs"`
+			Symlinks int64  `json:"symlinks"`
+			Other    int64  `json:"other"`
+			Total    int64  `json:"total"`
+		}{"tree_count", c[0], c[1], c[2], c[3], sum})
+		return
+	}
+	for i, name := range []string{"FILES", "DIRS", "SYMLINKS", "OTHER"} {
+		fmt.Fprintf(stdout, "%s: %d\n", name, c[i])
+	}
+	fmt.Fprintf(stdout, "TOTAL: %d\n", sum)
+}
+
+func printDirCounts(dirs map[string]int, asJSON bool) {
+	type dirCount struct {
+		Dir   string `json:"dir"`
+		Count int    `json:"count"`
+	}
+	keys := byCount(dirs)
+	if asJSON {
+		counts := make([]dirCount, len(keys))
+		for i, dir := range keys {
+			counts[i] = dirCount{filepath.ToSlash(dir), dirs[dir]}
+		}
+		b, _ := json.Marshal(counts)
+		fmt.Fprintf(stdout, "%s\n", b)
+		return
+	}
+	for _, dir := range keys {
+		fmt.Fprintf(stdout, "%d\t%s\n", dirs[dir], filepath.ToSlash(dir))
+	}
+}
+
+func printOwners(owners map[uint32][2]int64, asJSON bool) {
+	type ownerSummary struct {
+		User       string `json:"user"`
+		UID        uint32 `json:"uid"`
+		Count      int64  `json:"count"`
+		TotalBytes int64  `json:"total_bytes"`
+	}
+	summary := make([]ownerSummary, 0, len(owners))
+	for uid, c := range owners {
+		summary = append(summary, ownerSummary{userName(uid), uid, c[0], c[1]})
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i].TotalBytes != summary[j].TotalBytes {
+			return summary[i].TotalBytes > summary[j].TotalBytes
+		}
+		return summary[i].UID < summary[j].UID
+	})
+	if asJSON {
+		b, _ := json.Marshal(summary)
+		fmt.Fprintf(stdout, "%s\n", b)
+		return
+	}
+	for _, o := range summary {
+		fmt.Fprintf(stdout, "%s\t%d\t%s\n", o.User, o.Count, formatSize(o.TotalBytes, *sizeFormat))
+	}
+}
+
+func printMonths(months map[string][2]int64, asJSON bool) {
+	type monthSummary struct {
+		Month      string `json:"month"`
+		Count      int64  `json:"count"`
+		TotalBytes int64  `json:"total_bytes"`
+	}
+	keys := make([]string, 0, len(months))
+	for m := range months {
+		keys = append(keys, m)
+	}
+	sort.Strings(keys)
+	if asJSON {
+		summary := make([]monthSummary, len(keys))
+		for i, m := range keys {
+			summary[i] = monthSummary{m, months[m][0], months[m][1]}
+		}
+		b, _ := json.Marshal(summary)
+		fmt.Fprintf(stdout, "%s\n", b)
+		return
+	}
+	for _, m := range keys {
+		fmt.Fprintf(stdout, "%s\t%d\t%s\n", m, months[m][0], formatSize(months[m][1], *sizeFormat))
+	}
+}
+
+// watchTree starts watching a directory created after the initial listing
+// and emits the entries which were created before the watch was set up.
+func watchTree(dir string, emit func(string)) {
+	fis, err := readDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range fis {
+		path := filepath.Join(dir, fi.Name())
+		if ignoreMatch(path, fi.IsDir()) {
+			continue
+		}
+		if fi.IsDir() {
+			watchTree(path, emit)
+		}
+		if fi.IsDir() != *directoryOnly {
+			continue
+		}
+		if !matches(path, fi.Name()) {
+			continue
+		}
+		if accept(path, fi) {
+			emit(filepath.ToSlash(path))
 		}
 	}
 }
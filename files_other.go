@@ -0,0 +1,37 @@
+//go:build !unix && !windows
+
+package main
+
+import (
+	"os"
+)
+
+func fileBlocks(info os.FileInfo) (int64, bool) {
+	return 0, false
+}
+
+func fileNlink(path string, info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+func fileID(path string, info os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
+
+func fileRdev(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+func deviceNumbers(dev uint64) (major, minor uint64, ok bool) {
+	return 0, 0, false
+}
+
+func defaultFdLimit() int {
+	return 256
+}
+
+const ownerSupported = false
+
+func fileOwner(info os.FileInfo) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
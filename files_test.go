@@ -0,0 +1,876 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommonDir(t *testing.T) {
+	tests := []struct {
+		paths []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"x"}, ""},
+		{[]string{"a/b/z"}, "a/b/"},
+		{[]string{"a/b/z", "a/y"}, "a/"},
+		{[]string{"a/b/c/x", "a/bc/y"}, "a/"},
+		{[]string{"ab/x", "a/y"}, ""},
+		{[]string{"a/b/x", "a/b/y"}, "a/b/"},
+	}
+	for _, tt := range tests {
+		if got := commonDir(tt.paths, func(s string) string { return s }); got != tt.want {
+			t.Errorf("commonDir(%q) = %q, want %q", tt.paths, got, tt.want)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	defer func(re *regexp.Regexp, r string, anchored, full bool) {
+		matchre, root, *matchAnchored, *matchFullPath = re, r, anchored, full
+	}(matchre, root, *matchAnchored, *matchFullPath)
+	root = "base"
+
+	tests := []struct {
+		anchored, full bool
+		pattern, path  string
+		want           bool
+	}{
+		{false, false, "b", "base/a/b/z", false},
+		{false, false, "z", "base/a/b/z", true},
+		{true, false, "a/b", "base/a/b/z", true},
+		{true, false, "b", "base/a/b/z", false},
+		{true, false, "z", "base/z", true},
+		{true, false, "z", "base/a/z", false},
+		{true, false, "a/.*z$", "base/a/b/z", true},
+		{true, false, "base", "base/a", false},
+		{false, true, "a/b", "base/a/b/z", false},
+		{false, true, "a/b/z", "base/a/b/z", true},
+		{false, true, "a/.*", "base/a/b/z", true},
+		{true, true, "a/b", "base/a/b/z", false},
+	}
+	for _, tt := range tests {
+		*matchAnchored, *matchFullPath = tt.anchored, tt.full
+		matchre = regexp.MustCompile(matchPattern(tt.pattern))
+		path := filepath.FromSlash(tt.path)
+		if got := matches(path, filepath.Base(path)); got != tt.want {
+			t.Errorf("matches(%q) with -m %q, anchored=%v full=%v = %v, want %v", tt.path, tt.pattern, tt.anchored, tt.full, got, tt.want)
+		}
+	}
+}
+
+func TestShannonEntropy(t *testing.T) {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	tests := []struct {
+		in   []byte
+		want float64
+	}{
+		{nil, 0},
+		{[]byte("aaaa"), 0},
+		{[]byte("abab"), 1},
+		{[]byte("abcd"), 2},
+		{all, 8},
+	}
+	for _, tt := range tests {
+		if got := shannonEntropy(tt.in); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("shannonEntropy(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPrintTrailers(t *testing.T) {
+	defer func(w io.Writer, f, h string, counts, symlinks, tree bool) {
+		stdout, *format, *outputHash, *printCounts, *countSymlinks, *treeCount = w, f, h, counts, symlinks, tree
+	}(stdout, *format, *outputHash, *printCounts, *countSymlinks, *treeCount)
+	*outputHash, *printCounts, *countSymlinks, *treeCount = "sha256", true, true, true
+
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{"text", []string{"# symlinks:", "FILES:", "DIRS:", "SYMLINKS:", "OTHER:", "TOTAL:", "# sha256:", "# total: 3"}},
+		{"json", []string{`{"type":"symlinks","symlink_count":0}`, `{"type":"tree_count"`, `{"type":"output_hash"`, `{"type":"total","count":3}`}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		stdout, *format = &buf, tt.format
+		printTrailers(3, sha256.New())
+		lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		if len(lines) != len(tt.want) {
+			t.Errorf("%s: got %q, want %d lines", tt.format, lines, len(tt.want))
+			continue
+		}
+		for i, prefix := range tt.want {
+			if !strings.HasPrefix(lines[i], prefix) {
+				t.Errorf("%s: line %d = %q, want prefix %q", tt.format, i, lines[i], prefix)
+			}
+		}
+	}
+}
+
+func TestIsHidden(t *testing.T) {
+	defer func(r string) { root = r }(root)
+	root = filepath.FromSlash("home/user")
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"home/user", false},
+		{"home/user/.bashrc", true},
+		{"home/user/.config", true},
+		{"home/user/.config/git/config", true},
+		{"home/user/src/.git/HEAD", true},
+		{"home/user/src/main.go", false},
+		{"home/user/src/a.b", false},
+	}
+	for _, tt := range tests {
+		if got := isHidden(filepath.FromSlash(tt.path)); got != tt.want {
+			t.Errorf("isHidden(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSparse(t *testing.T) {
+	defer func(s string) { *sparse = s }(*sparse)
+
+	dir := t.TempDir()
+	// A file written after seeking past its end has a hole before the data.
+	holes := filepath.Join(dir, "holes")
+	f, err := os.Create(holes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(1<<20, io.SeekStart); err == nil {
+		_, err = f.Write([]byte("x"))
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := filepath.Join(dir, "full")
+	if err := os.WriteFile(full, bytes.Repeat([]byte("x"), 1<<16), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sparse, path string
+		want         bool
+	}{
+		{"include", holes, true},
+		{"include", full, true},
+		{"exclude", holes, false},
+		{"exclude", full, true},
+		{"only", holes, true},
+		{"only", full, false},
+	}
+	for _, tt := range tests {
+		fi, err := os.Lstat(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fileBlocks(fi); !ok {
+			t.Skip("no block counts on this system")
+		}
+		*sparse = tt.sparse
+		if got := accept(tt.path, fi); got != tt.want {
+			t.Errorf("accept(%s) with -sparse %s = %v, want %v", filepath.Base(tt.path), tt.sparse, got, tt.want)
+		}
+	}
+}
+
+func TestMinBlocks(t *testing.T) {
+	defer func(min, max int64) { *minBlocks, *maxBlocks = min, max }(*minBlocks, *maxBlocks)
+
+	// A 10GB sparse file taking a single block.
+	fi := indexInfo{&indexEntry{Path: "disk.img", Size: 10 << 30, Stat: fileStat{Blocks: 1, HasBlocks: true}}}
+	if _, ok := fileBlocks(fi); !ok {
+		t.Skip("no block counts on this system")
+	}
+	tests := []struct {
+		min, max int64
+		want     bool
+	}{
+		{-1, -1, true},
+		{1, -1, true},
+		{10, -1, false},
+		{-1, 1, true},
+		{-1, 0, false},
+		{1, 1, true},
+	}
+	for _, tt := range tests {
+		*minBlocks, *maxBlocks = tt.min, tt.max
+		if got := accept(fi.e.Path, fi); got != tt.want {
+			t.Errorf("accept with -min-blocks %d -max-blocks %d = %v, want %v", tt.min, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"512", 512, true},
+		{"512B", 512, true},
+		{"1K", 1 << 10, true},
+		{"1k", 1 << 10, true},
+		{"1KB", 1 << 10, true},
+		{"1M", 1 << 20, true},
+		{"2G", 2 << 30, true},
+		{"1T", 1 << 40, true},
+		{"", 0, false},
+		{"K", 0, false},
+		{"1.5M", 0, false},
+		{"1X", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSkipLarger(t *testing.T) {
+	defer func(n byteSize) { *skipLarger = n }(*skipLarger)
+	*skipLarger = 1 << 20
+
+	tests := []struct {
+		fi   indexInfo
+		want bool
+	}{
+		{indexInfo{&indexEntry{Path: "README.md", Size: 4 << 10}}, true},
+		{indexInfo{&indexEntry{Path: "exact.txt", Size: 1 << 20}}, true},
+		{indexInfo{&indexEntry{Path: "blob.bin", Size: 1<<20 + 1}}, false},
+		{indexInfo{&indexEntry{Path: "video.mp4", Size: 3 << 30}}, false},
+		{indexInfo{&indexEntry{Path: "dir", Size: 8 << 20, Mode: os.ModeDir}}, true},
+	}
+	for _, tt := range tests {
+		if got := accept(tt.fi.e.Path, tt.fi); got != tt.want {
+			t.Errorf("accept(%s) of %d bytes with -skip-larger 1M = %v, want %v", tt.fi.e.Path, tt.fi.e.Size, got, tt.want)
+		}
+	}
+}
+
+// makeTree creates the files in a temporary directory, with names ending
+// in a slash made directories, and returns the directory.
+func makeTree(t *testing.T, names ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range names {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// walkTree walks base like files does without -A and returns the paths
+// found, relative to base.
+func walkTree(t *testing.T, base string) []string {
+	t.Helper()
+	defer func(re *regexp.Regexp, r string) { ignorere, root = re, r }(ignorere, root)
+	ignorere = regexp.MustCompile(ignorePattern(*ignore))
+	setRoot(base)
+	var paths []string
+	for p := range filesSync(base) {
+		rel, err := filepath.Rel(base, filepath.FromSlash(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, filepath.ToSlash(rel))
+	}
+	return paths
+}
+
+func TestMinDepthFiles(t *testing.T) {
+	defer func(n int) { *minDepthFiles = n }(*minDepthFiles)
+	base := makeTree(t, "README", "src/a.go", "src/pkg/b.go")
+
+	tests := []struct {
+		depth int
+		want  []string
+	}{
+		{0, []string{"README", "src/a.go", "src/pkg/b.go"}},
+		{1, []string{"README", "src/a.go", "src/pkg/b.go"}},
+		{2, []string{"src/a.go", "src/pkg/b.go"}},
+		{3, []string{"src/pkg/b.go"}},
+		{4, nil},
+	}
+	for _, tt := range tests {
+		*minDepthFiles = tt.depth
+		if got := walkTree(t, base); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-min-depth-files %d found %q, want %q", tt.depth, got, tt.want)
+		}
+	}
+}
+
+func TestNoRecurse(t *testing.T) {
+	defer func(b bool) { *noRecurse = b }(*noRecurse)
+	base := makeTree(t, "a", "sub/b", "sub/deep/c")
+
+	tests := []struct {
+		noRecurse bool
+		want      []string
+	}{
+		{false, []string{"a", "sub/b", "sub/deep/c"}},
+		{true, []string{"a"}},
+	}
+	for _, tt := range tests {
+		*noRecurse = tt.noRecurse
+		if got := walkTree(t, base); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-no-recurse=%v found %q, want %q", tt.noRecurse, got, tt.want)
+		}
+	}
+}
+
+func TestMaxTotalSize(t *testing.T) {
+	defer func(n byteSize) {
+		*maxTotalSize, totalSize, sizeExceeded = n, 0, 0
+	}(*maxTotalSize)
+	base := t.TempDir()
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		if err := os.WriteFile(filepath.Join(base, name), bytes.Repeat([]byte("x"), 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		max   byteSize
+		found int
+	}{
+		{-1, 5},
+		{0, 0},
+		{99, 0},
+		{100, 1},
+		{250, 2},
+		{500, 5},
+	}
+	for _, tt := range tests {
+		*maxTotalSize, totalSize, sizeExceeded = tt.max, 0, 0
+		var total int64
+		paths := walkTree(t, base)
+		for _, p := range paths {
+			fi, err := os.Stat(filepath.Join(base, p))
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += fi.Size()
+		}
+		if len(paths) != tt.found || tt.max >= 0 && total > int64(tt.max) {
+			t.Errorf("-max-total-size %d found %d files of %d bytes, want %d files", tt.max, len(paths), total, tt.found)
+		}
+	}
+}
+
+func TestParsePermCheck(t *testing.T) {
+	tests := []struct {
+		in   string
+		want permCheck
+		ok   bool
+	}{
+		{"0777", permCheck{07777, 0777}, true},
+		{"644", permCheck{07777, 0644}, true},
+		{"0002:0002", permCheck{02, 02}, true},
+		{"04000:04000", permCheck{04000, 04000}, true},
+		{"0022:0", permCheck{022, 0}, true},
+		{"", permCheck{}, false},
+		{"0789", permCheck{}, false},
+		{"x:0002", permCheck{}, false},
+		{"0002:", permCheck{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parsePermCheck(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parsePermCheck(%q) = %o, %v, want %o, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCheckPerms(t *testing.T) {
+	defer func(c []permCheck) { permChecks = c }(permChecks)
+
+	tests := []struct {
+		check string
+		mode  os.FileMode
+		want  bool
+	}{
+		{"0644", 0644, true},
+		{"0644", 0640, false},
+		{"0002:0002", 0666, true},
+		{"0002:0002", 0644, false},
+		{"0002:0002", 0777 | os.ModeSticky, true},
+		{"04000:04000", 0755 | os.ModeSetuid, true},
+		{"04000:04000", 0755, false},
+		{"02000:02000", 0755 | os.ModeSetgid, true},
+		{"07777", 0755 | os.ModeSetuid, false},
+	}
+	for _, tt := range tests {
+		c, err := parsePermCheck(tt.check)
+		if err != nil {
+			t.Fatal(err)
+		}
+		permChecks = []permCheck{c}
+		fi := indexInfo{&indexEntry{Path: "f", Mode: tt.mode}}
+		if got := accept("f", fi); got != tt.want {
+			t.Errorf("accept of mode %v with -check-perms %s = %v, want %v", tt.mode, tt.check, got, tt.want)
+		}
+	}
+}
+
+func TestParseIDRange(t *testing.T) {
+	lookup := func(name string) (string, error) {
+		if name == "www-data" {
+			return "33", nil
+		}
+		return "", errors.New("unknown user " + name)
+	}
+	tests := []struct {
+		in   string
+		want *idRange
+	}{
+		{"0", &idRange{0, 0}},
+		{"1000", &idRange{1000, 1000}},
+		{"1000-1999", &idRange{1000, 1999}},
+		{"5-5", &idRange{5, 5}},
+		{"www-data", &idRange{33, 33}},
+		{"nobody", nil},
+		{"2000-1000", nil},
+		{"1-x", nil},
+		{"4294967296", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseIDRange(tt.in, lookup)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseIDRange(%q) = %v, want an error", tt.in, *got)
+			}
+			continue
+		}
+		if err != nil || *got != *tt.want {
+			t.Errorf("parseIDRange(%q) = %v, %v, want %v", tt.in, got, err, *tt.want)
+		}
+	}
+}
+
+func TestExtCaseFold(t *testing.T) {
+	defer func(fold, coalesce bool) { *extCaseFold, *coalesceExts = fold, coalesce }(*extCaseFold, *coalesceExts)
+	*coalesceExts = true
+	base := makeTree(t, "a.go", "b.GO", "c.Go", "d.tar.gz", "e.TAR.GZ", "Makefile")
+
+	tests := []struct {
+		fold bool
+		want map[string]int
+	}{
+		{false, map[string]int{".go": 1, ".GO": 1, ".Go": 1, ".tar.gz": 1, ".GZ": 1}},
+		{true, map[string]int{".go": 3, ".tar.gz": 2}},
+	}
+	for _, tt := range tests {
+		*extCaseFold = tt.fold
+		got := map[string]int{}
+		for _, p := range walkTree(t, base) {
+			if ext := extKey(p); ext != "" {
+				got[ext]++
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-ext-case-fold=%v counted %v, want %v", tt.fold, got, tt.want)
+		}
+	}
+}
+
+func TestNameLength(t *testing.T) {
+	defer func(min, max int, runes bool) {
+		*minNameLen, *maxNameLen, *inRunes = min, max, runes
+	}(*minNameLen, *maxNameLen, *inRunes)
+
+	tests := []struct {
+		name     string
+		min, max int
+		runes    bool
+		want     bool
+	}{
+		{strings.Repeat("a", 255), -1, 255, false, true},
+		{strings.Repeat("a", 256), -1, 255, false, false},
+		{strings.Repeat("a", 255), 256, -1, false, false},
+		{strings.Repeat("a", 256), 256, -1, false, true},
+		// 100 characters of 3 bytes each.
+		{strings.Repeat("あ", 100), -1, 255, false, false},
+		{strings.Repeat("あ", 100), -1, 255, true, true},
+		{strings.Repeat("あ", 100), 101, -1, true, false},
+		{strings.Repeat("あ", 100), 101, -1, false, true},
+	}
+	for _, tt := range tests {
+		*minNameLen, *maxNameLen, *inRunes = tt.min, tt.max, tt.runes
+		fi := indexInfo{&indexEntry{Path: tt.name}}
+		if got := accept(tt.name, fi); got != tt.want {
+			t.Errorf("accept of a %d byte name with -min-name-length %d -max-name-length %d -in-runes=%v = %v, want %v", len(tt.name), tt.min, tt.max, tt.runes, got, tt.want)
+		}
+	}
+}
+
+func TestEscapesDir(t *testing.T) {
+	dir := makeTree(t, "tree/file", "tree/sub/", "outside")
+	tree := filepath.Join(dir, "tree")
+	links := []struct {
+		name, target string
+		escapes      bool
+	}{
+		{"rel-in", "file", false},
+		{"rel-sub", "sub/../file", false},
+		{"sub/rel-up", "../file", false},
+		{"rel-out", "../outside", true},
+		{"sub/rel-out", "../../outside", true},
+		{"abs-in", filepath.Join(tree, "file"), false},
+		{"abs-out", filepath.Join(dir, "outside"), true},
+		{"abs-root", string(filepath.Separator), true},
+		{"abs-prefix", tree + "2", true},
+	}
+	for _, l := range links {
+		if err := os.Symlink(filepath.FromSlash(l.target), filepath.Join(tree, filepath.FromSlash(l.name))); err != nil {
+			t.Skip("can't create symlinks:", err)
+		}
+	}
+	for _, l := range links {
+		if got := escapesDir(filepath.Join(tree, filepath.FromSlash(l.name)), tree); got != l.escapes {
+			t.Errorf("escapesDir(%s -> %s) = %v, want %v", l.name, l.target, got, l.escapes)
+		}
+	}
+	if escapesDir(filepath.Join(tree, "file"), tree) {
+		t.Errorf("escapesDir of a regular file = true, want false")
+	}
+}
+
+func TestExcludeNewer(t *testing.T) {
+	defer func(name string, newest time.Time) { *excludeNewer, newestTime = name, newest }(*excludeNewer, newestTime)
+	dir := makeTree(t, "ref", "before", "same", "after")
+	ref := time.Now().Add(-time.Hour).Truncate(time.Second)
+	tests := []struct {
+		name  string
+		mtime time.Time
+		want  bool
+	}{
+		{"before", ref.Add(-time.Second), true},
+		{"same", ref, true},
+		{"after", ref.Add(time.Second), false},
+	}
+	if err := os.Chtimes(filepath.Join(dir, "ref"), ref, ref); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "ref"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	*excludeNewer, newestTime = filepath.Join(dir, "ref"), fi.ModTime()
+
+	for _, tt := range tests {
+		p := filepath.Join(dir, tt.name)
+		if err := os.Chtimes(p, tt.mtime, tt.mtime); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := accept(p, fi); got != tt.want {
+			t.Errorf("accept(%s) with -exclude-newer = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOmitPattern(t *testing.T) {
+	defer func(re *regexp.Regexp, l regexpList) { matchre, *omitPatterns = re, l }(matchre, *omitPatterns)
+	base := makeTree(t, "main.go", "main_test.go", "README.md", "pkg/a.go", "pkg/a_test.go", "vendor/x/x.go")
+	matchre = regexp.MustCompile(matchPattern(`\.go$`))
+
+	tests := []struct {
+		patterns []string
+		want     []string
+	}{
+		{nil, []string{"main.go", "main_test.go", "pkg/a.go", "pkg/a_test.go", "vendor/x/x.go"}},
+		{[]string{`_test\.go$`}, []string{"main.go", "pkg/a.go", "vendor/x/x.go"}},
+		{[]string{`_test\.go$`, `^vendor/`}, []string{"main.go", "pkg/a.go"}},
+		{[]string{`\.md$`}, []string{"main.go", "main_test.go", "pkg/a.go", "pkg/a_test.go", "vendor/x/x.go"}},
+	}
+	for _, tt := range tests {
+		*omitPatterns = nil
+		for _, p := range tt.patterns {
+			omitPatterns.Set(p)
+		}
+		var got []string
+		for _, p := range walkTree(t, base) {
+			if !omitted(p) {
+				got = append(got, p)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-m '\\.go$' -omit-pattern %q found %q, want %q", tt.patterns, got, tt.want)
+		}
+	}
+}
+
+func TestReadDirBudget(t *testing.T) {
+	budget := 200 * time.Millisecond
+	tests := []struct {
+		delay time.Duration
+		ok    bool
+	}{
+		{0, true},
+		{budget / 10, true},
+		{budget * 2, false},
+	}
+	for _, tt := range tests {
+		read := func(p string) ([]os.FileInfo, error) {
+			time.Sleep(tt.delay)
+			return []os.FileInfo{indexInfo{&indexEntry{Path: "a"}}}, nil
+		}
+		fis, err := readDirBudget("dir", budget, read)
+		if ok := err == nil && len(fis) == 1; ok != tt.ok {
+			t.Errorf("readDirBudget taking %v of %v = %d entries, %v, want ok %v", tt.delay, budget, len(fis), err, tt.ok)
+		}
+	}
+}
+
+func TestEvalSymlinks(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// l1 -> l2 -> l3 -> l4 -> l5 -> target
+	for i := 1; i <= 5; i++ {
+		next := "l" + strconv.Itoa(i+1)
+		if i == 5 {
+			next = "target"
+		}
+		if err := os.Symlink(next, filepath.Join(dir, "l"+strconv.Itoa(i))); err != nil {
+			t.Skip("can't create symlinks:", err)
+		}
+	}
+
+	tests := []struct {
+		path string
+		max  int
+		ok   bool
+	}{
+		{"l1", 3, false},
+		{"l1", 4, false},
+		{"l1", 5, true},
+		{"l1", 40, true},
+		{"l3", 3, true},
+		{"target", 0, true},
+		{"l5", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := evalSymlinks(filepath.Join(dir, tt.path), tt.max)
+		if tt.ok && (err != nil || got != target) {
+			t.Errorf("evalSymlinks(%s, %d) = %q, %v, want %q", tt.path, tt.max, got, err, target)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("evalSymlinks(%s, %d) = %q, want an error", tt.path, tt.max, got)
+		}
+	}
+}
+
+func TestNoCrossSymlink(t *testing.T) {
+	defer func(s string) { rootAbs = s }(rootAbs)
+	dir := makeTree(t, "root/file", "root/sub/", "outside")
+	base := filepath.Join(dir, "root")
+	links := map[string]string{
+		"in":      "file",
+		"sub/up":  "../file",
+		"abs-in":  filepath.Join(base, "file"),
+		"out":     "../outside",
+		"abs-out": filepath.Join(dir, "outside"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(filepath.FromSlash(target), filepath.Join(base, filepath.FromSlash(name))); err != nil {
+			t.Skip("can't create symlinks:", err)
+		}
+	}
+
+	tests := []struct {
+		noCross bool
+		want    []string
+	}{
+		{false, []string{"abs-in", "abs-out", "file", "in", "out", "sub/up"}},
+		{true, []string{"abs-in", "file", "in", "sub/up"}},
+	}
+	for _, tt := range tests {
+		rootAbs = ""
+		if tt.noCross {
+			rootAbs = base
+		}
+		if got := walkTree(t, base); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-no-cross-symlink=%v found %q, want %q", tt.noCross, got, tt.want)
+		}
+	}
+}
+
+func TestDeviceFilters(t *testing.T) {
+	defer func(dev, block, char bool) {
+		*devFiles, *noBlockDevs, *noCharDevs = dev, block, char
+	}(*devFiles, *noBlockDevs, *noCharDevs)
+	files := []indexInfo{
+		{&indexEntry{Path: "file", Mode: 0644}},
+		{&indexEntry{Path: "sda", Mode: os.ModeDevice | 0660}},
+		{&indexEntry{Path: "tty", Mode: os.ModeDevice | os.ModeCharDevice | 0620}},
+	}
+
+	tests := []struct {
+		dev, noBlock, noChar bool
+		want                 []string
+	}{
+		{false, false, false, []string{"file"}},
+		{true, false, false, []string{"file", "sda", "tty"}},
+		{true, true, false, []string{"file", "tty"}},
+		{true, false, true, []string{"file", "sda"}},
+		{true, true, true, []string{"file"}},
+	}
+	for _, tt := range tests {
+		*devFiles, *noBlockDevs, *noCharDevs = tt.dev, tt.noBlock, tt.noChar
+		var got []string
+		for _, fi := range files {
+			if accept(fi.e.Path, fi) {
+				got = append(got, fi.e.Path)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-dev-files=%v -no-block-devices=%v -no-char-devices=%v kept %q, want %q", tt.dev, tt.noBlock, tt.noChar, got, tt.want)
+		}
+	}
+}
+
+func TestModeExceedsMax(t *testing.T) {
+	tests := []struct {
+		mode, max os.FileMode
+		want      bool
+	}{
+		{0400, 0644, false},
+		{0644, 0644, false},
+		{0755, 0644, true},
+		{0777, 0644, true},
+		{0600, 0644, false},
+		{0604, 0640, true},
+		{0755, 0755, false},
+		{0777, 0755, true},
+		{0644 | os.ModeSetuid, 0644, false},
+		{0755 | os.ModeDir, 0755, false},
+	}
+	for _, tt := range tests {
+		if got := modeExceedsMax(tt.mode, tt.max); got != tt.want {
+			t.Errorf("modeExceedsMax(%v, %04o) = %v, want %v", tt.mode, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestLastComponents(t *testing.T) {
+	tests := []struct {
+		path string
+		n    int
+		want string
+	}{
+		{"/a/b/c/d/e.go", 2, "d/e.go"},
+		{"/a/b/c/d/e.go", 1, "e.go"},
+		{"a/b/c", 3, "a/b/c"},
+		{"a/b/c", 4, "a/b/c"},
+		{"a/b/c", 10, "a/b/c"},
+		{"/a/b/c", 3, "a/b/c"},
+		{"/a/b/c", 4, "/a/b/c"},
+		{"e.go", 1, "e.go"},
+		{"e.go", 2, "e.go"},
+	}
+	for _, tt := range tests {
+		if got := lastComponents(tt.path, tt.n); got != tt.want {
+			t.Errorf("lastComponents(%q, %d) = %q, want %q", tt.path, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestWithPathSep(t *testing.T) {
+	tests := []struct {
+		path, sep, want string
+	}{
+		{"a/b/c.txt", `\`, `a\b\c.txt`},
+		{"a/b/c.txt", "%2F", "a%2Fb%2Fc.txt"},
+		{"/abs/dir/", "::", "::abs::dir::"},
+		{"a/b/c.txt", "", "a/b/c.txt"},
+		{"name", `\`, "name"},
+		{"", `\`, ""},
+	}
+	for _, tt := range tests {
+		if got := withPathSep(tt.path, tt.sep); got != tt.want {
+			t.Errorf("withPathSep(%q, %q) = %q, want %q", tt.path, tt.sep, got, tt.want)
+		}
+	}
+}
+
+func TestExtensionless(t *testing.T) {
+	defer func(noEmpty, only bool) {
+		*noEmptyExt, *onlyNoExt = noEmpty, only
+	}(*noEmptyExt, *onlyNoExt)
+
+	tests := []struct {
+		path                string
+		dir                 bool
+		noEmpty, only, want bool
+	}{
+		{"Makefile", false, false, false, true},
+		{"Makefile", false, true, false, false},
+		{"Makefile", false, false, true, true},
+		{"src/Dockerfile", false, true, false, false},
+		{"src/Dockerfile", false, false, true, true},
+		{"LICENSE", false, true, false, false},
+		{"README", false, false, true, true},
+		{"main.go", false, true, false, true},
+		{"main.go", false, false, true, false},
+		{"archive.tar.gz", false, false, true, false},
+		// Directories are never filtered, so the walk still reaches the
+		// files below them.
+		{"cmd", true, true, false, true},
+		{"cmd.d", true, false, true, true},
+	}
+	for _, tt := range tests {
+		*noEmptyExt, *onlyNoExt = tt.noEmpty, tt.only
+		mode := os.FileMode(0644)
+		if tt.dir {
+			mode = os.ModeDir | 0755
+		}
+		fi := indexInfo{&indexEntry{Path: tt.path, Mode: mode}}
+		if got := accept(tt.path, fi); got != tt.want {
+			t.Errorf("accept(%s) with -no-empty-extensions=%v -only-extensionless=%v = %v, want %v", tt.path, tt.noEmpty, tt.only, got, tt.want)
+		}
+	}
+}
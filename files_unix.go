@@ -0,0 +1,90 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+func fileBlocks(info os.FileInfo) (int64, bool) {
+	if st, ok := indexedStat(info); ok {
+		return st.Blocks, st.HasBlocks
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int64(st.Blocks), true
+}
+
+func fileNlink(path string, info os.FileInfo) (uint64, bool) {
+	if st, ok := indexedStat(info); ok {
+		return st.Nlink, st.HasNlink
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Nlink), true
+}
+
+func fileID(path string, info os.FileInfo) (dev, ino uint64, ok bool) {
+	if st, ok := indexedStat(info); ok {
+		return st.Dev, st.Ino, st.HasID
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Dev), uint64(st.Ino), true
+}
+
+// fileRdev returns the device ID of a device file.
+func fileRdev(info os.FileInfo) (uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Rdev), true
+}
+
+// deviceNumbers splits a device ID into its major and minor numbers, which
+// each system encodes differently.
+func deviceNumbers(dev uint64) (major, minor uint64, ok bool) {
+	switch runtime.GOOS {
+	case "linux", "android":
+		return (dev>>8)&0xfff | (dev>>32)&^0xfff, dev&0xff | (dev>>12)&^0xff, true
+	case "darwin", "ios":
+		return (dev >> 24) & 0xff, dev & 0xffffff, true
+	case "freebsd", "dragonfly":
+		return (dev>>32)&0xffffff00 | (dev>>8)&0xff, (dev>>24)&0xff00 | dev&0xffff00ff, true
+	case "netbsd":
+		return (dev & 0xfff00) >> 8, (dev&0xfff00000)>>12 | dev&0xff, true
+	case "openbsd":
+		return (dev & 0xff00) >> 8, dev&0xff | (dev&0xffff0000)>>8, true
+	}
+	return 0, 0, false
+}
+
+func defaultFdLimit() int {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil || rlim.Cur == 0 {
+		return 256
+	}
+	return fdLimitOf(uint64(rlim.Cur))
+}
+
+const ownerSupported = true
+
+func fileOwner(info os.FileInfo) (uid, gid uint32, ok bool) {
+	if st, ok := indexedStat(info); ok {
+		return st.UID, st.GID, st.HasOwner
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return st.Uid, st.Gid, true
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func fileBlocks(info os.FileInfo) (int64, bool) {
+	return 0, false
+}
+
+func fileInformation(path string) (*syscall.ByHandleFileInformation, bool) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, false
+	}
+	h, err := syscall.CreateFile(p, 0,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil, syscall.OPEN_EXISTING,
+		syscall.FILE_FLAG_BACKUP_SEMANTICS|syscall.FILE_FLAG_OPEN_REPARSE_POINT, 0)
+	if err != nil {
+		return nil, false
+	}
+	defer syscall.CloseHandle(h)
+
+	var d syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(h, &d); err != nil {
+		return nil, false
+	}
+	return &d, true
+}
+
+func fileNlink(path string, info os.FileInfo) (uint64, bool) {
+	if st, ok := indexedStat(info); ok {
+		return st.Nlink, st.HasNlink
+	}
+	d, ok := fileInformation(path)
+	if !ok {
+		return 0, false
+	}
+	return uint64(d.NumberOfLinks), true
+}
+
+func fileID(path string, info os.FileInfo) (dev, ino uint64, ok bool) {
+	if st, ok := indexedStat(info); ok {
+		return st.Dev, st.Ino, st.HasID
+	}
+	d, ok := fileInformation(path)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(d.VolumeSerialNumber), uint64(d.FileIndexHigh)<<32 | uint64(d.FileIndexLow), true
+}
+
+func fileRdev(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+func deviceNumbers(dev uint64) (major, minor uint64, ok bool) {
+	return 0, 0, false
+}
+
+func defaultFdLimit() int {
+	// Go opens files as handles, not through the C runtime, so the only
+	// limit is the 2^24 handles a process can have.
+	return fdLimitOf(1 << 24)
+}
+
+const ownerSupported = false
+
+func fileOwner(info os.FileInfo) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// result is a displayed path, stat'd on demand for columns which need it.
+type result struct {
+	path string
+	fi   os.FileInfo
+	done bool
+}
+
+func (r *result) info() os.FileInfo {
+	if !r.done {
+		r.fi, _ = os.Lstat(filepath.FromSlash(r.path))
+		r.done = true
+	}
+	return r.fi
+}
+
+// column is an output field computed from a result.
+type column struct {
+	name  string
+	value func(r *result) interface{}
+}
+
+var (
+	userNamesMu sync.Mutex
+	userNames   = map[uint32]string{}
+)
+
+func ownerName(fi os.FileInfo) string {
+	uid, _, ok := fileOwner(fi)
+	if !ok {
+		return "-"
+	}
+	return userName(uid)
+}
+
+// userName returns the name of the user, or the uid if it has none.
+func userName(uid uint32) string {
+	userNamesMu.Lock()
+	defer userNamesMu.Unlock()
+	name, ok := userNames[uid]
+	if !ok {
+		name = strconv.FormatUint(uint64(uid), 10)
+		if u, err := user.LookupId(name); err == nil {
+			name = u.Username
+		}
+		userNames[uid] = name
+	}
+	return name
+}
+
+// formatSize formats n bytes as is, or with -size-format si or iec in
+// units of 1000 or 1024 bytes, like 1.5MB or 1.5MiB.
+func formatSize(n int64, format string) string {
+	unit, prefixes, suffix := int64(1000), "kMGTPE", "B"
+	switch format {
+	case "si":
+	case "iec":
+		unit, prefixes, suffix = 1024, "KMGTPE", "iB"
+	default:
+		return strconv.FormatInt(n, 10)
+	}
+	if n < unit && n > -unit {
+		return strconv.FormatInt(n, 10) + "B"
+	}
+	f := float64(n)
+	i := -1
+	for ; (f >= float64(unit) || f <= -float64(unit)) && i < 5; i++ {
+		f /= float64(unit)
+	}
+	return strconv.FormatFloat(f, 'f', 1, 64) + prefixes[i:i+1] + suffix
+}
+
+var ageUnits = []struct {
+	name string
+	d    time.Duration
+}{
+	{"year", 365 * 24 * time.Hour},
+	{"month", 30 * 24 * time.Hour},
+	{"day", 24 * time.Hour},
+	{"hour", time.Hour},
+	{"minute", time.Minute},
+	{"second", time.Second},
+}
+
+// relativeAge returns how long before now t is, like "3 days ago", in the
+// largest whole unit. Ages below the unit of precision are "just now".
+func relativeAge(t, now time.Time, precision string) string {
+	d := now.Sub(t)
+	future := d < 0
+	if future {
+		d = -d
+	}
+	for _, u := range ageUnits {
+		if d >= u.d {
+			n := int64(d / u.d)
+			s := strconv.FormatInt(n, 10) + " " + u.name
+			if n != 1 {
+				s += "s"
+			}
+			if future {
+				return "in " + s
+			}
+			return s + " ago"
+		}
+		if u.name+"s" == precision {
+			break
+		}
+	}
+	return "just now"
+}
+
+var previewBufs sync.Pool
+
+// contentPreview returns the first n bytes of the file, or 80 when n is
+// not positive, with control characters and broken UTF-8 replaced by dots.
+func contentPreview(path string, n int) string {
+	if n <= 0 {
+		n = 80
+	}
+	f, err := openFile(path)
+	if err != nil {
+		return ""
+	}
+	defer closeFile(f)
+
+	buf, _ := previewBufs.Get().(*[]byte)
+	if buf == nil || cap(*buf) < n {
+		b := make([]byte, n)
+		buf = &b
+	}
+	defer previewBufs.Put(buf)
+
+	m, _ := io.ReadFull(f, (*buf)[:n])
+	s := strings.ToValidUTF8(string((*buf)[:m]), ".")
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return '.'
+		}
+		return r
+	}, s)
+}
+
+// columnDefs are the columns selectable with -columns, other than PATH
+// which depends on how paths are displayed.
+var columnDefs = map[string]func(r *result) interface{}{
+	"SIZE": func(r *result) interface{} {
+		if fi := r.info(); fi != nil {
+			if *sizeFormat != "bytes" {
+				return formatSize(fi.Size(), *sizeFormat)
+			}
+			return fi.Size()
+		}
+		return nil
+	},
+	"MTIME": func(r *result) interface{} {
+		if fi := r.info(); fi != nil {
+			return fi.ModTime().Format(time.RFC3339)
+		}
+		return nil
+	},
+	"AGE": func(r *result) interface{} {
+		if fi := r.info(); fi != nil {
+			return relativeAge(fi.ModTime(), time.Now(), *agePrecision)
+		}
+		return nil
+	},
+	"MODE": func(r *result) interface{} {
+		if fi := r.info(); fi != nil {
+			return fi.Mode().String()
+		}
+		return nil
+	},
+	"OWNER": func(r *result) interface{} {
+		if fi := r.info(); fi != nil {
+			return ownerName(fi)
+		}
+		return nil
+	},
+	"NLINKS": func(r *result) interface{} {
+		if fi := r.info(); fi != nil {
+			if n, ok := fileNlink(filepath.FromSlash(r.path), fi); ok {
+				return n
+			}
+		}
+		return nil
+	},
+	"GIT_ROOT": func(r *result) interface{} {
+		dir, err := filepath.Abs(filepath.Dir(filepath.FromSlash(r.path)))
+		if err != nil {
+			return nil
+		}
+		if root := gitRoot(dir); root != "" {
+			return filepath.ToSlash(root)
+		}
+		return nil
+	},
+	"DEVICE": func(r *result) interface{} {
+		if fi := r.info(); fi != nil {
+			if dev, _, ok := fileID(filepath.FromSlash(r.path), fi); ok {
+				return dev
+			}
+		}
+		return nil
+	},
+	"DEVICE_MAJOR": func(r *result) interface{} {
+		if fi := r.info(); fi != nil {
+			if dev, _, ok := fileID(filepath.FromSlash(r.path), fi); ok {
+				if major, _, ok := deviceNumbers(dev); ok {
+					return major
+				}
+			}
+		}
+		return nil
+	},
+	"DEVICE_MINOR": func(r *result) interface{} {
+		if fi := r.info(); fi != nil {
+			if dev, _, ok := fileID(filepath.FromSlash(r.path), fi); ok {
+				if _, minor, ok := deviceNumbers(dev); ok {
+					return minor
+				}
+			}
+		}
+		return nil
+	},
+	"DEVICE_TYPE": func(r *result) interface{} {
+		if fi := r.info(); fi != nil && fi.Mode()&os.ModeDevice != 0 {
+			if fi.Mode()&os.ModeCharDevice != 0 {
+				return "char"
+			}
+			return "block"
+		}
+		return nil
+	},
+	"RDEV_MAJOR": func(r *result) interface{} {
+		if fi := r.info(); fi != nil && fi.Mode()&os.ModeDevice != 0 {
+			if rdev, ok := fileRdev(fi); ok {
+				if major, _, ok := deviceNumbers(rdev); ok {
+					return major
+				}
+			}
+		}
+		return nil
+	},
+	"RDEV_MINOR": func(r *result) interface{} {
+		if fi := r.info(); fi != nil && fi.Mode()&os.ModeDevice != 0 {
+			if rdev, ok := fileRdev(fi); ok {
+				if _, minor, ok := deviceNumbers(rdev); ok {
+					return minor
+				}
+			}
+		}
+		return nil
+	},
+	"SYMLINK_CHAIN": func(r *result) interface{} {
+		if fi := r.info(); fi != nil && fi.Mode()&os.ModeSymlink != 0 {
+			return symlinkChain(filepath.FromSlash(r.path), *maxLinkDepth)
+		}
+		return nil
+	},
+	"ACL": func(r *result) interface{} {
+		if acl := fileACL(filepath.FromSlash(r.path)); acl != nil {
+			return acl
+		}
+		return nil
+	},
+	"SELINUX_CONTEXT": func(r *result) interface{} {
+		if ctx := fileSELinux(filepath.FromSlash(r.path)); ctx != "" {
+			return ctx
+		}
+		return nil
+	},
+	"PREVIEW": func(r *result) interface{} {
+		if fi := r.info(); fi != nil && fi.Mode().IsRegular() {
+			return contentPreview(filepath.FromSlash(r.path), *previewBytes)
+		}
+		return nil
+	},
+}
+
+// aclEntry is an entry of a POSIX ACL. Qualifier is the user or group
+// name of named entries, and empty for the others.
+type aclEntry struct {
+	Type      string `json:"type"`
+	Qualifier string `json:"qualifier"`
+	Perm      string `json:"perm"`
+}
+
+// aclEntries is an ACL, displayed in the short getfacl form like
+// "user::rw-,group::r--,other::r--".
+type aclEntries []aclEntry
+
+func (acl aclEntries) String() string {
+	s := make([]string, len(acl))
+	for i, e := range acl {
+		s[i] = e.Type + ":" + e.Qualifier + ":" + e.Perm
+	}
+	return strings.Join(s, ",")
+}
+
+// parseColumns parses a comma separated list of column names. pathCols
+// are the columns computed from the displayed path.
+func parseColumns(s string, pathCols map[string]func(r *result) interface{}) ([]column, error) {
+	var cols []column
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if value, ok := pathCols[name]; ok {
+			cols = append(cols, column{name, value})
+			continue
+		}
+		value, ok := columnDefs[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid column %q for -columns", name)
+		}
+		cols = append(cols, column{name, value})
+	}
+	return cols, nil
+}
+
+func fieldString(v interface{}) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprint(v)
+}
+
+// formatter writes one result per call to write. Formats with headers
+// take the column names from the first call.
+type formatter interface {
+	write(names []string, fields []interface{}) error
+	flush() error
+}
+
+// formatSpec describes a value of -format.
+type formatSpec struct {
+	name        string
+	description string
+	new         func(w io.Writer, header bool) formatter
+}
+
+var formats = map[string]formatSpec{
+	"text": {"text", "Fields separated by tabs", func(w io.Writer, header bool) formatter {
+		return &textFormatter{w: w}
+	}},
+	"table": {"table", "Aligned columns with a header row", func(w io.Writer, header bool) formatter {
+		return &tableFormatter{tw: tabwriter.NewWriter(w, 0, 8, 2, ' ', 0), header: header}
+	}},
+	"table-no-header": {"table-no-header", "Aligned columns without a header row", func(w io.Writer, header bool) formatter {
+		return &tableFormatter{tw: tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)}
+	}},
+	"csv": {"csv", "Comma separated values with a header row", func(w io.Writer, header bool) formatter {
+		return &csvFormatter{cw: csv.NewWriter(w), header: header}
+	}},
+	"json": {"json", "A JSON object per line keyed by lowercase column names", func(w io.Writer, header bool) formatter {
+		return &jsonFormatter{w: w, pretty: *jsonPretty, indent: *jsonIndent}
+	}},
+}
+
+func newFormatter(format string, w io.Writer, header bool) (formatter, error) {
+	spec, ok := formats[format]
+	if !ok {
+		return nil, fmt.Errorf("invalid value %q for -format", format)
+	}
+	return spec.new(w, header), nil
+}
+
+// listFormats prints each format with its description and the output for
+// a sample file.
+func listFormats(w io.Writer) error {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FORMAT\tDESCRIPTION\tEXAMPLE")
+	for _, name := range names {
+		spec := formats[name]
+		var buf bytes.Buffer
+		f := spec.new(&buf, false)
+		f.write([]string{"PATH", "SIZE"}, []interface{}{"src/main.go", int64(1024)})
+		f.flush()
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", spec.name, spec.description, strings.TrimSpace(buf.String()))
+	}
+	return tw.Flush()
+}
+
+type textFormatter struct {
+	w io.Writer
+}
+
+func (f *textFormatter) write(names []string, fields []interface{}) error {
+	line := make([]string, len(fields))
+	for i, v := range fields {
+		line[i] = fieldString(v)
+	}
+	_, err := fmt.Fprintln(f.w, strings.Join(line, "\t"))
+	return err
+}
+
+func (f *textFormatter) flush() error {
+	return nil
+}
+
+type tableFormatter struct {
+	tw      *tabwriter.Writer
+	header  bool
+	started bool
+}
+
+func (f *tableFormatter) write(names []string, fields []interface{}) error {
+	if !f.started {
+		f.started = true
+		if f.header {
+			fmt.Fprintln(f.tw, strings.Join(names, "\t"))
+		}
+	}
+	line := make([]string, len(fields))
+	for i, v := range fields {
+		line[i] = fieldString(v)
+	}
+	_, err := fmt.Fprintln(f.tw, strings.Join(line, "\t"))
+	return err
+}
+
+func (f *tableFormatter) flush() error {
+	return f.tw.Flush()
+}
+
+type csvFormatter struct {
+	cw      *csv.Writer
+	header  bool
+	started bool
+}
+
+func (f *csvFormatter) write(names []string, fields []interface{}) error {
+	if !f.started {
+		f.started = true
+		if f.header {
+			f.cw.Write(names)
+		}
+	}
+	record := make([]string, len(fields))
+	for i, v := range fields {
+		if v != nil {
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	return f.cw.Write(record)
+}
+
+func (f *csvFormatter) flush() error {
+	f.cw.Flush()
+	return f.cw.Error()
+}
+
+// jsonFormatter writes a JSON object per line with the keys in column
+// order. With pretty, the keys and values are spaced out, and with indent
+// each object is written over several lines.
+type jsonFormatter struct {
+	w      io.Writer
+	pretty bool
+	indent int
+}
+
+func (f *jsonFormatter) write(names []string, fields []interface{}) error {
+	sep, colon := ",", ":"
+	if f.pretty {
+		sep, colon = ", ", ": "
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, v := range fields {
+		if i > 0 {
+			buf.WriteString(sep)
+		}
+		k, _ := json.Marshal(strings.ToLower(names[i]))
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(k)
+		buf.WriteString(colon)
+		buf.Write(b)
+	}
+	buf.WriteByte('}')
+	if f.indent > 0 {
+		var out bytes.Buffer
+		if err := json.Indent(&out, buf.Bytes(), "", strings.Repeat(" ", f.indent)); err != nil {
+			return err
+		}
+		buf = out
+	}
+	buf.WriteByte('\n')
+	_, err := f.w.Write(buf.Bytes())
+	return err
+}
+
+func (f *jsonFormatter) flush() error {
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n      int64
+		format string
+		want   string
+	}{
+		{0, "bytes", "0"},
+		{1536, "bytes", "1536"},
+		{0, "si", "0B"},
+		{999, "si", "999B"},
+		{1000, "si", "1.0kB"},
+		{1500, "si", "1.5kB"},
+		{1500000, "si", "1.5MB"},
+		{2 * 1000 * 1000 * 1000, "si", "2.0GB"},
+		{-1500, "si", "-1.5kB"},
+		{1023, "iec", "1023B"},
+		{1024, "iec", "1.0KiB"},
+		{1536, "iec", "1.5KiB"},
+		{3 << 20, "iec", "3.0MiB"},
+		{1 << 40, "iec", "1.0TiB"},
+		{1 << 62, "iec", "4.0EiB"},
+	}
+	for _, tt := range tests {
+		if got := formatSize(tt.n, tt.format); got != tt.want {
+			t.Errorf("formatSize(%d, %q) = %q, want %q", tt.n, tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestJSONFormatter(t *testing.T) {
+	names := []string{"PATH", "SIZE"}
+	rows := [][]interface{}{{"a/b", int64(1)}, {"c, d: e", nil}}
+	tests := []struct {
+		pretty bool
+		indent int
+		want   string
+	}{
+		{false, 0, `{"path":"a/b","size":1}` + "\n" + `{"path":"c, d: e","size":null}` + "\n"},
+		{true, 0, `{"path": "a/b", "size": 1}` + "\n" + `{"path": "c, d: e", "size": null}` + "\n"},
+		{false, 2, "{\n  \"path\": \"a/b\",\n  \"size\": 1\n}\n{\n  \"path\": \"c, d: e\",\n  \"size\": null\n}\n"},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		f := &jsonFormatter{w: &b, pretty: tt.pretty, indent: tt.indent}
+		for _, row := range rows {
+			if err := f.write(names, row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := b.String(); got != tt.want {
+			t.Errorf("pretty=%v indent=%d wrote %q, want %q", tt.pretty, tt.indent, got, tt.want)
+		}
+		// Without an indent, each line is an object of its own.
+		if tt.indent == 0 {
+			for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+				if !json.Valid([]byte(line)) {
+					t.Errorf("pretty=%v: line %q is not valid JSON", tt.pretty, line)
+				}
+			}
+		}
+	}
+}
+
+func TestRelativeAge(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		age       time.Duration
+		precision string
+		want      string
+	}{
+		{0, "seconds", "just now"},
+		{time.Second, "seconds", "1 second ago"},
+		{30 * time.Second, "seconds", "30 seconds ago"},
+		{30 * time.Second, "minutes", "just now"},
+		{time.Minute, "minutes", "1 minute ago"},
+		{90 * time.Minute, "minutes", "1 hour ago"},
+		{59 * time.Minute, "hours", "just now"},
+		{2 * time.Hour, "hours", "2 hours ago"},
+		{23 * time.Hour, "days", "just now"},
+		{48 * time.Hour, "days", "2 days ago"},
+		{45 * 24 * time.Hour, "days", "1 month ago"},
+		{800 * 24 * time.Hour, "days", "2 years ago"},
+		{-time.Second, "seconds", "in 1 second"},
+		{-3 * time.Hour, "minutes", "in 3 hours"},
+		{-30 * time.Second, "minutes", "just now"},
+	}
+	for _, tt := range tests {
+		if got := relativeAge(now.Add(-tt.age), now, tt.precision); got != tt.want {
+			t.Errorf("relativeAge(now-%v, %s) = %q, want %q", tt.age, tt.precision, got, tt.want)
+		}
+	}
+}
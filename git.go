@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// gitPaths runs git in base and returns the NUL separated paths it prints
+// joined to base, as the walk would produce them.
+func gitPaths(base string, args ...string) ([]string, error) {
+	cmd := exec.Command("git", append([]string{"-C", base}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return nil, fmt.Errorf("git %s: %v", args[0], err)
+	}
+	var paths []string
+	for _, f := range strings.Split(string(b), "\x00") {
+		if f != "" {
+			paths = append(paths, filepath.Join(base, filepath.FromSlash(f)))
+		}
+	}
+	return paths, nil
+}
+
+// The git commands listing the files of -git-tracked and -git-untracked.
+var (
+	trackedArgs   = []string{"ls-files", "-z", "--cached"}
+	untrackedArgs = []string{"ls-files", "-z", "--others", "--exclude-standard"}
+)
+
+// gitFiles is like gitPaths but returns a set, which also contains the
+// parent directories of the paths when displaying directories.
+func gitFiles(base string, args ...string) (map[string]bool, error) {
+	paths, err := gitPaths(base, args...)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]bool{}
+	for _, p := range paths {
+		files[p] = true
+		if *directoryOnly {
+			for d := filepath.Dir(p); d != base && d != "." && !files[d]; d = filepath.Dir(d) {
+				files[d] = true
+			}
+		}
+	}
+	return files, nil
+}
+
+var repoMarkers = map[string][]string{
+	"git":  {".git"},
+	"hg":   {".hg"},
+	"svn":  {".svn"},
+	"auto": {".git", ".hg", ".svn"},
+}
+
+// findRepoRoot walks up from dir until a directory containing a marker of
+// the given VCS type is found.
+func findRepoRoot(dir, typ string) (string, error) {
+	markers, ok := repoMarkers[typ]
+	if !ok {
+		return "", fmt.Errorf("invalid value %q for -repo-root-type", typ)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		for _, m := range markers {
+			if _, err := os.Stat(filepath.Join(dir, m)); err == nil {
+				return dir, nil
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	if typ == "auto" {
+		return "", fmt.Errorf("not inside a repository")
+	}
+	return "", fmt.Errorf("not inside a %s repository", typ)
+}
+
+var (
+	gitRootsMu sync.Mutex
+	gitRoots   = map[string]string{}
+)
+
+// gitRoot returns the root of the git repository containing the absolute
+// directory dir, or "" when there is none. Results are cached for each
+// directory up the tree.
+func gitRoot(dir string) string {
+	gitRootsMu.Lock()
+	r, ok := gitRoots[dir]
+	gitRootsMu.Unlock()
+	if ok {
+		return r
+	}
+	if _, err := os.Lstat(filepath.Join(dir, ".git")); err == nil {
+		r = dir
+	} else if parent := filepath.Dir(dir); parent != dir {
+		r = gitRoot(parent)
+	}
+	gitRootsMu.Lock()
+	gitRoots[dir] = r
+	gitRootsMu.Unlock()
+	return r
+}
+
+// isGitRepo reports whether dir is the root of a git work tree or a bare
+// repository.
+func isGitRepo(dir string) bool {
+	if _, err := os.Lstat(filepath.Join(dir, ".git")); err == nil {
+		return true
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	for _, d := range []string{"objects", "refs"} {
+		if fi, err := os.Stat(filepath.Join(dir, d)); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// gitConfig returns the value of the git config key in base, or "" when
+// it isn't set.
+func gitConfig(base, key string) (string, error) {
+	cmd := exec.Command("git", "-C", base, "config", "--get", key)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 1 {
+			return "", nil
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git config: %s", msg)
+		}
+		return "", fmt.Errorf("git config: %v", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// gitVerifyCommit reports a readable error if rev does not name a commit.
+func gitVerifyCommit(base, rev string) error {
+	cmd := exec.Command("git", "-C", base, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: unknown commit", strings.TrimPrefix(rev, "refs/tags/"))
+	}
+	return nil
+}
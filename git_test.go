@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitUntracked(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if b, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, b)
+		}
+	}
+	write := func(name string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("init", "-q")
+	write("modified")
+	write("ignored.log")
+	if err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("add", ".gitignore", "modified")
+	git("commit", "-q", "-m", "initial")
+	write("staged")
+	git("add", "staged")
+	if err := os.WriteFile(filepath.Join(dir, "modified"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	write("untracked")
+
+	tracked, err := gitFiles(dir, trackedArgs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untracked, err := gitFiles(dir, untrackedArgs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name               string
+		tracked, untracked bool
+	}{
+		{".gitignore", true, false},
+		{"modified", true, false},
+		{"staged", true, false},
+		{"untracked", false, true},
+		{"ignored.log", false, false},
+	}
+	for _, tt := range tests {
+		p := filepath.Join(dir, tt.name)
+		if tracked[p] != tt.tracked || untracked[p] != tt.untracked {
+			t.Errorf("%s: tracked %v, untracked %v, want %v, %v", tt.name, tracked[p], untracked[p], tt.tracked, tt.untracked)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// hookCommand runs the shell command line cmd with arg appended as its
+// last argument.
+func hookCommand(ctx context.Context, cmd, arg string) *exec.Cmd {
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = exec.CommandContext(ctx, "cmd", "/c", cmd+` "`+arg+`"`)
+	} else {
+		c = exec.CommandContext(ctx, "sh", "-c", cmd+` "$1"`, "sh", arg)
+	}
+	// Don't wait for children of the shell holding the output open once
+	// the shell has been killed.
+	c.WaitDelay = time.Second
+	return c
+}
+
+// contentFilter runs the -content-filter-dir script for dir and compiles
+// the ignore patterns it prints, one per line.
+func contentFilter(dir string) []*regexp.Regexp {
+	ctx, cancel := context.WithTimeout(context.Background(), *hookTimeout)
+	defer cancel()
+
+	cmd := hookCommand(ctx, *dirFilterCmd, dir)
+	cmd.Stderr = os.Stderr
+	b, err := cmd.Output()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *dirFilterCmd, err)
+		return nil
+	}
+	var res []*regexp.Regexp
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		re, err := regexp.Compile(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *dirFilterCmd, err)
+			continue
+		}
+		res = append(res, re)
+	}
+	return res
+}
+
+// dirHook runs the -walk-dir-hook command for dir and returns the paths it
+// prints, one per line. Relative paths are taken to be relative to dir.
+func dirHook(dir string) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), *hookTimeout)
+	defer cancel()
+
+	cmd := hookCommand(ctx, *walkDirHook, dir)
+	cmd.Stderr = os.Stderr
+	b, err := cmd.Output()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *walkDirHook, err)
+	}
+	var res []string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(dir, line)
+		}
+		res = append(res, line)
+	}
+	return res
+}
+
+// fileHook reports whether the -file-hook command exits successfully for
+// path.
+func fileHook(path string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), *hookTimeout)
+	defer cancel()
+
+	cmd := hookCommand(ctx, *fileHookCmd, path)
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil && ctx.Err() != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *fileHookCmd, ctx.Err())
+	} else if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *fileHookCmd, err)
+	}
+	return err == nil
+}
+
+// scopedIgnores returns the extra ignore patterns active below dir.
+func scopedIgnores(dir string, parent []*regexp.Regexp) []*regexp.Regexp {
+	if *dirFilterCmd == "" {
+		return parent
+	}
+	res := contentFilter(dir)
+	if len(res) == 0 {
+		return parent
+	}
+	return append(parent[:len(parent):len(parent)], res...)
+}
+
+// ignoreMatch reports whether the entry matches the ignore pattern, which
+// is matched against the name, or with -ignore-anchored the slash separated
+// path from the base. Directories also match with a trailing slash.
+// Temporary files and the directories of -omit-dirs are matched by name.
+func ignoreMatch(path string, isDir bool) bool {
+	if isDir && omitDirNames[filepath.Base(path)] {
+		return true
+	}
+	if isTempFile(filepath.Base(path)) {
+		return true
+	}
+	if !*ignoreAnchor {
+		return ignorere.MatchString(filepath.Base(path))
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		rel = path
+	}
+	rel = filepath.ToSlash(rel)
+	return ignorere.MatchString(rel) || isDir && ignorere.MatchString(rel+"/")
+}
+
+// isIgnored reports whether the entry matches the ignore pattern or one of
+// the patterns scoped to the directory being walked.
+func isIgnored(path string, isDir bool, scoped []*regexp.Regexp) bool {
+	if ignoreMatch(path, isDir) {
+		atomic.AddInt64(&ignoredCount, 1)
+		return true
+	}
+	name := filepath.Base(path)
+	for _, re := range scoped {
+		if re.MatchString(name) {
+			atomic.AddInt64(&ignoredCount, 1)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestFileHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hooks are sh commands")
+	}
+	defer func(cmd string) { *fileHookCmd = cmd }(*fileHookCmd)
+	base := makeTree(t, "a", "b/TODO", "b/c")
+
+	tests := []struct {
+		hook string
+		want []string
+	}{
+		{"true", []string{"a", "b/TODO", "b/c"}},
+		{"false", nil},
+		{"grep -qF TODO", []string{"b/TODO"}},
+	}
+	for _, tt := range tests {
+		*fileHookCmd = tt.hook
+		if got := walkTree(t, base); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-file-hook %q found %q, want %q", tt.hook, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const indexVersion = 2
+
+type indexHeader struct {
+	Version int
+	Created time.Time
+	Base    string
+}
+
+type indexEntry struct {
+	Path    string
+	Mode    os.FileMode
+	Size    int64
+	ModTime int64
+	Stat    fileStat
+}
+
+// fileStat keeps what the filters read from the system dependent part of
+// a FileInfo, with a flag for each group telling whether it was available.
+type fileStat struct {
+	UID       uint32 `json:"uid"`
+	GID       uint32 `json:"gid"`
+	HasOwner  bool   `json:"has_owner"`
+	Nlink     uint64 `json:"nlink"`
+	HasNlink  bool   `json:"has_nlink"`
+	Blocks    int64  `json:"blocks"`
+	HasBlocks bool   `json:"has_blocks"`
+	Dev       uint64 `json:"dev"`
+	Ino       uint64 `json:"ino"`
+	HasID     bool   `json:"has_id"`
+}
+
+func newFileStat(path string, fi os.FileInfo) fileStat {
+	var st fileStat
+	st.UID, st.GID, st.HasOwner = fileOwner(fi)
+	st.Nlink, st.HasNlink = fileNlink(path, fi)
+	st.Blocks, st.HasBlocks = fileBlocks(fi)
+	st.Dev, st.Ino, st.HasID = fileID(path, fi)
+	return st
+}
+
+// indexedStat returns the stat fields recorded in the index for a FileInfo
+// read back from it.
+func indexedStat(fi os.FileInfo) (*fileStat, bool) {
+	st, ok := fi.Sys().(*fileStat)
+	return st, ok
+}
+
+// indexInfo is the FileInfo of an index entry, whose Sys returns the
+// recorded *fileStat.
+type indexInfo struct {
+	e *indexEntry
+}
+
+func (fi indexInfo) Name() string       { return filepath.Base(filepath.FromSlash(fi.e.Path)) }
+func (fi indexInfo) Size() int64        { return fi.e.Size }
+func (fi indexInfo) Mode() os.FileMode  { return fi.e.Mode }
+func (fi indexInfo) ModTime() time.Time { return time.Unix(0, fi.e.ModTime) }
+func (fi indexInfo) IsDir() bool        { return fi.e.Mode.IsDir() }
+func (fi indexInfo) Sys() interface{}   { return &fi.e.Stat }
+
+// indexWriter collects the results of a walk for -create-index.
+type indexWriter struct {
+	base    string
+	entries []indexEntry
+}
+
+func (w *indexWriter) add(path string) {
+	fi, err := os.Lstat(filepath.FromSlash(path))
+	if err != nil {
+		return
+	}
+	w.entries = append(w.entries, indexEntry{
+		Path:    path,
+		Mode:    fi.Mode(),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UnixNano(),
+		Stat:    newFileStat(filepath.FromSlash(path), fi),
+	})
+}
+
+func (w *indexWriter) save(name string) error {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(f)
+	err = enc.Encode(indexHeader{indexVersion, time.Now(), w.base})
+	if err == nil {
+		err = enc.Encode(w.entries)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func loadIndex(name string) (indexHeader, []indexEntry, error) {
+	var h indexHeader
+	var entries []indexEntry
+	f, err := os.Open(name)
+	if err != nil {
+		return h, nil, err
+	}
+	defer f.Close()
+	dec := gob.NewDecoder(f)
+	if err := dec.Decode(&h); err != nil {
+		return h, nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if h.Version != indexVersion {
+		return h, nil, fmt.Errorf("%s: unsupported index version %d", name, h.Version)
+	}
+	if err := dec.Decode(&entries); err != nil {
+		return h, nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return h, entries, nil
+}
+
+// filesIndex sends the entries of an index passing the filters, like
+// filesList but without touching the filesystem.
+func filesIndex(base string, entries []indexEntry) chan string {
+	q := make(chan string, 20)
+
+	go func() {
+		for i := range entries {
+			path := filepath.FromSlash(entries[i].Path)
+			if hasIgnoredName(base, path) {
+				continue
+			}
+			fi := indexInfo{&entries[i]}
+			if fi.IsDir() != *directoryOnly {
+				continue
+			}
+			if !matches(path, fi.Name()) {
+				continue
+			}
+			if !accept(path, fi) {
+				continue
+			}
+			if emit(q, path, fi) != nil {
+				break
+			}
+		}
+		close(q)
+	}()
+
+	return q
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestIndexRoundTrip(t *testing.T) {
+	base := makeTree(t, "a.go", "b.txt", "sub/c.go")
+	w := &indexWriter{base: base}
+	for _, p := range []string{"a.go", "b.txt", "sub", "sub/c.go"} {
+		w.add(filepath.ToSlash(filepath.Join(base, filepath.FromSlash(p))))
+	}
+	name := filepath.Join(t.TempDir(), "files.idx")
+	start := time.Now()
+	if err := w.save(name); err != nil {
+		t.Fatal(err)
+	}
+
+	h, entries, err := loadIndex(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != indexVersion || h.Base != base || h.Created.Before(start.Add(-time.Second)) {
+		t.Errorf("header = %+v, want version %d and base %q created now", h, indexVersion, base)
+	}
+	if !reflect.DeepEqual(entries, w.entries) {
+		t.Errorf("entries = %+v, want %+v", entries, w.entries)
+	}
+	for _, e := range entries {
+		fi, err := os.Lstat(filepath.FromSlash(e.Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ifi := indexInfo{&e}
+		if ifi.Size() != fi.Size() || ifi.Mode() != fi.Mode() || !ifi.ModTime().Equal(fi.ModTime()) {
+			t.Errorf("%s: indexed %d %v %v, want %d %v %v", e.Path, ifi.Size(), ifi.Mode(), ifi.ModTime(), fi.Size(), fi.Mode(), fi.ModTime())
+		}
+		if n, ok := fileNlink(e.Path, fi); ok {
+			if got, _ := fileNlink(e.Path, ifi); got != n {
+				t.Errorf("%s: indexed nlink %d, want %d", e.Path, got, n)
+			}
+		}
+	}
+
+	// Querying the index applies the filters without the filesystem.
+	defer func(m, i *regexp.Regexp) { matchre, ignorere = m, i }(matchre, ignorere)
+	matchre = regexp.MustCompile(matchPattern(`\.go$`))
+	ignorere = regexp.MustCompile(ignorePattern(*ignore))
+	var got []string
+	for p := range filesIndex(base, entries) {
+		rel, _ := filepath.Rel(base, filepath.FromSlash(p))
+		got = append(got, filepath.ToSlash(rel))
+	}
+	if want := []string{"a.go", "sub/c.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("query -m '\\.go$' = %q, want %q", got, want)
+	}
+}
+
+func TestIndexVersion(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "files.idx")
+	w := &indexWriter{}
+	if err := w.save(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadIndex(name); err != nil {
+		t.Errorf("loadIndex of an empty index: %v", err)
+	}
+	if err := os.WriteFile(name, []byte("not an index"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadIndex(name); err == nil {
+		t.Errorf("loadIndex of garbage succeeded")
+	}
+}
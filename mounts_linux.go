@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const mountsSupported = true
+
+// virtualFS are the filesystem types which don't hold files on disk.
+var virtualFS = map[string]bool{
+	"autofs": true, "binfmt_misc": true, "bpf": true, "cgroup": true,
+	"cgroup2": true, "configfs": true, "debugfs": true, "devpts": true,
+	"devtmpfs": true, "efivarfs": true, "fusectl": true, "hugetlbfs": true,
+	"mqueue": true, "nsfs": true, "proc": true, "pstore": true,
+	"ramfs": true, "rpc_pipefs": true, "securityfs": true, "sysfs": true,
+	"tmpfs": true, "tracefs": true,
+}
+
+// networkFS are the filesystem types skipped with -local-only.
+var networkFS = map[string]bool{
+	"9p": true, "afs": true, "ceph": true, "cifs": true, "fuse.sshfs": true,
+	"glusterfs": true, "lustre": true, "nfs": true, "nfs4": true,
+	"smb3": true, "smbfs": true, "sshfs": true,
+}
+
+// mountPoints returns the mount points listed in /proc/mounts, and the
+// ones with files to walk.
+func mountPoints(localOnly bool) (all map[string]bool, walk []string, err error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	all = map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		dir, typ := unescapeMount(fields[1]), fields[2]
+		if all[dir] {
+			continue
+		}
+		all[dir] = true
+		if virtualFS[typ] || localOnly && networkFS[typ] {
+			continue
+		}
+		walk = append(walk, dir)
+	}
+	return all, walk, scanner.Err()
+}
+
+// unescapeMount decodes the octal escapes of spaces and other characters
+// in /proc/mounts fields.
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
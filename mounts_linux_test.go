@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestUnescapeMount(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"/mnt/data", "/mnt/data"},
+		{`/mnt/my\040disk`, "/mnt/my disk"},
+		{`/mnt/a\011b\012c`, "/mnt/a\tb\nc"},
+		{`/mnt/back\134slash`, `/mnt/back\slash`},
+		{`/mnt/end\040`, "/mnt/end "},
+		{`/mnt/short\04`, `/mnt/short\04`},
+		{`/mnt/not\999octal`, `/mnt/not\999octal`},
+	}
+	for _, tt := range tests {
+		if got := unescapeMount(tt.in); got != tt.want {
+			t.Errorf("unescapeMount(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
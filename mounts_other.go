@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+const mountsSupported = false
+
+func mountPoints(localOnly bool) (all map[string]bool, walk []string, err error) {
+	return nil, nil, nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var hashAlgos = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// hashPath returns the hex SHA-256 of path, or its HMAC-SHA256 keyed with
+// salt when salt is not empty.
+func hashPath(path, salt string) string {
+	var h hash.Hash
+	if salt != "" {
+		h = hmac.New(sha256.New, []byte(salt))
+	} else {
+		h = sha256.New()
+	}
+	io.WriteString(h, path)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// atomicWriter holds all output until flush, spilling to a temporary file
+// once more than max bytes are buffered (max < 0 means no limit).
+type atomicWriter struct {
+	max int64
+	buf bytes.Buffer
+	tmp *os.File
+}
+
+func (w *atomicWriter) Write(p []byte) (int, error) {
+	if w.tmp == nil && w.max >= 0 && int64(w.buf.Len()+len(p)) > w.max {
+		f, err := os.CreateTemp("", "files")
+		if err != nil {
+			return 0, err
+		}
+		os.Remove(f.Name())
+		if _, err := f.Write(w.buf.Bytes()); err != nil {
+			f.Close()
+			return 0, err
+		}
+		w.buf.Reset()
+		w.tmp = f
+	}
+	if w.tmp != nil {
+		return w.tmp.Write(p)
+	}
+	return w.buf.Write(p)
+}
+
+// flush writes the buffered output to out in a single write, or copies the
+// temporary file when the output did not fit in memory, and empties w for
+// the output following.
+func (w *atomicWriter) flush(out io.Writer) error {
+	if w.tmp == nil {
+		_, err := out.Write(w.buf.Bytes())
+		w.buf.Reset()
+		return err
+	}
+	defer func() {
+		w.tmp.Close()
+		w.tmp = nil
+	}()
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(out, w.tmp)
+	return err
+}
+
+// pathDiff compares the displayed paths with the paths of a previous
+// output for -print-diff-from.
+type pathDiff struct {
+	previous map[string]string // by pathKey
+}
+
+func newPathDiff(list map[string]bool) *pathDiff {
+	d := &pathDiff{make(map[string]string, len(list))}
+	for p := range list {
+		d.previous[pathKey(p)] = p
+	}
+	return d
+}
+
+// mark returns s as is when it was in the previous output, or prefixed
+// with + when it is new.
+func (d *pathDiff) mark(s string) string {
+	if _, ok := d.previous[pathKey(s)]; ok {
+		delete(d.previous, pathKey(s))
+		return s
+	}
+	return "+" + s
+}
+
+// missing returns the previous paths which were not marked, sorted.
+func (d *pathDiff) missing() []string {
+	paths := make([]string, 0, len(d.previous))
+	for _, s := range d.previous {
+		paths = append(paths, s)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// parallelWrite formats the paths from q with n goroutines, each writing
+// to its own temporary file, and copies the files to out in turn once q is
+// drained. It returns the number of paths written.
+func parallelWrite(q <-chan string, n int, out io.Writer, format string, row func(s string) []interface{}, names []string) (int, error) {
+	files := make([]*os.File, n)
+	counts := make([]int, n)
+	errs := make([]error, n)
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+				os.Remove(f.Name())
+			}
+		}
+	}()
+	for i := range files {
+		f, err := os.CreateTemp("", "files")
+		if err != nil {
+			return 0, err
+		}
+		files[i] = f
+	}
+	var wg sync.WaitGroup
+	for i := range files {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bw := bufio.NewWriter(files[i])
+			f, err := newFormatter(format, bw, false)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			for s := range q {
+				counts[i]++
+				if errs[i] == nil {
+					errs[i] = f.write(names, row(s))
+				}
+			}
+			if err := f.flush(); errs[i] == nil {
+				errs[i] = err
+			}
+			if err := bw.Flush(); errs[i] == nil {
+				errs[i] = err
+			}
+		}(i)
+	}
+	wg.Wait()
+	total := 0
+	for i, f := range files {
+		total += counts[i]
+		if errs[i] != nil {
+			return total, errs[i]
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return total, err
+		}
+		if _, err := io.Copy(out, f); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+var (
+	makeEscaper  = strings.NewReplacer(" ", `\ `, "#", `\#`, "$", "$$")
+	cmakeEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, ";", `\;`)
+	ninjaEscaper = strings.NewReplacer(" ", "$ ", ":", "$:", "$", "$$", "\n", "$\n")
+)
+
+// manifestFormats write the paths as a list variable for each build
+// system, one path per line.
+var manifestFormats = map[string]func(w io.Writer, variable string, paths []string){
+	"make": func(w io.Writer, variable string, paths []string) {
+		io.WriteString(w, variable+" :=")
+		for _, p := range paths {
+			io.WriteString(w, " \\\n  "+makeEscaper.Replace(p))
+		}
+		io.WriteString(w, "\n")
+	},
+	"cmake": func(w io.Writer, variable string, paths []string) {
+		io.WriteString(w, "set("+variable+"\n")
+		for _, p := range paths {
+			io.WriteString(w, `  "`+cmakeEscaper.Replace(p)+"\"\n")
+		}
+		io.WriteString(w, ")\n")
+	},
+	"ninja": func(w io.Writer, variable string, paths []string) {
+		io.WriteString(w, variable+" =")
+		for _, p := range paths {
+			io.WriteString(w, " $\n    "+ninjaEscaper.Replace(p))
+		}
+		io.WriteString(w, "\n")
+	},
+}
+
+// writeManifest writes the paths to name as a variable of the build system
+// format.
+func writeManifest(name, format, variable string, paths []string) error {
+	var buf bytes.Buffer
+	manifestFormats[format](&buf, variable, paths)
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// checksumTree hashes each directory from the files below it, like a
+// Merkle tree. A file is hashed by its name, size and mtime, not content,
+// and a directory by the sorted names and hashes of its entries.
+type checksumTree struct {
+	root    string
+	files   map[string]map[string]string
+	subdirs map[string]map[string]bool
+}
+
+func newChecksumTree(root string) *checksumTree {
+	return &checksumTree{
+		root:    root,
+		files:   map[string]map[string]string{},
+		subdirs: map[string]map[string]bool{},
+	}
+}
+
+// add records the slash separated path of a file.
+func (t *checksumTree) add(p string, fi os.FileInfo) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d", fi.Name(), fi.Size(), fi.ModTime().UnixNano())
+	dir := path.Dir(p)
+	if t.files[dir] == nil {
+		t.files[dir] = map[string]string{}
+	}
+	t.files[dir][path.Base(p)] = hex.EncodeToString(h.Sum(nil))
+
+	for d := dir; d != t.root; d = path.Dir(d) {
+		parent := path.Dir(d)
+		if parent == d || t.subdirs[parent][path.Base(d)] {
+			break
+		}
+		if t.subdirs[parent] == nil {
+			t.subdirs[parent] = map[string]bool{}
+		}
+		t.subdirs[parent][path.Base(d)] = true
+	}
+}
+
+func (t *checksumTree) sum(dir string, sums map[string]string) string {
+	var entries []string
+	for name, h := range t.files[dir] {
+		entries = append(entries, "f\x00"+name+"\x00"+h)
+	}
+	for name := range t.subdirs[dir] {
+		entries = append(entries, "d\x00"+name+"\x00"+t.sum(path.Join(dir, name), sums))
+	}
+	sort.Strings(entries)
+	h := sha256.New()
+	for _, e := range entries {
+		io.WriteString(h, e+"\n")
+	}
+	sums[dir] = hex.EncodeToString(h.Sum(nil))
+	return sums[dir]
+}
+
+// print writes the hash of every directory, parents before their
+// subdirectories.
+func (t *checksumTree) print(w io.Writer, show func(string) string) error {
+	sums := map[string]string{}
+	t.sum(t.root, sums)
+
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		if _, err := fmt.Fprintf(w, "%s %s\n", sums[dir], show(dir)); err != nil {
+			return err
+		}
+		names := make([]string, 0, len(t.subdirs[dir]))
+		for name := range t.subdirs[dir] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := walk(path.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(t.root)
+}
+
+// splitWriter distributes rows across n files named prefix.0 to
+// prefix.n-1, each formatted on its own. Rows go round-robin, or with
+// byHash to the file picked by a hash of the path, so a path lands in the
+// same file on every run.
+type splitWriter struct {
+	files  []*os.File
+	bufs   []*bufio.Writer
+	fmts   []formatter
+	next   int
+	byHash bool
+}
+
+func newSplitWriter(prefix string, n int, format string, header, byHash bool) (*splitWriter, error) {
+	w := &splitWriter{byHash: byHash}
+	for i := 0; i < n; i++ {
+		f, err := os.Create(fmt.Sprintf("%s.%d", prefix, i))
+		if err != nil {
+			w.close()
+			return nil, err
+		}
+		bw := bufio.NewWriter(f)
+		ff, err := newFormatter(format, bw, header)
+		if err != nil {
+			f.Close()
+			w.close()
+			return nil, err
+		}
+		w.files = append(w.files, f)
+		w.bufs = append(w.bufs, bw)
+		w.fmts = append(w.fmts, ff)
+	}
+	return w, nil
+}
+
+func (w *splitWriter) write(path string, names []string, fields []interface{}) error {
+	i := w.next
+	if w.byHash {
+		h := fnv.New32a()
+		io.WriteString(h, path)
+		i = int(h.Sum32() % uint32(len(w.fmts)))
+	} else {
+		w.next = (w.next + 1) % len(w.fmts)
+	}
+	return w.fmts[i].write(names, fields)
+}
+
+// close flushes and closes all the files, returning the first error.
+func (w *splitWriter) close() error {
+	var err error
+	for i, f := range w.files {
+		if e := w.fmts[i].flush(); e != nil && err == nil {
+			err = e
+		}
+		if e := w.bufs[i].Flush(); e != nil && err == nil {
+			err = e
+		}
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
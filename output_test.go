@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteManifest(t *testing.T) {
+	tests := []struct {
+		paths []string
+		want  string
+	}{
+		{nil, "SRCS :=\n"},
+		{[]string{"a.go", "b/c.go"}, "SRCS := \\\n  a.go \\\n  b/c.go\n"},
+		{[]string{"a b#c$d"}, "SRCS := \\\n  a\\ b\\#c$$d\n"},
+	}
+	name := filepath.Join(t.TempDir(), "files.mk")
+	for _, tt := range tests {
+		if err := writeManifest(name, "make", "SRCS", tt.paths); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != tt.want {
+			t.Errorf("manifest of %q = %q, want %q", tt.paths, got, tt.want)
+		}
+	}
+}
+
+func TestManifestFormats(t *testing.T) {
+	paths := []string{"a b/c#d", `e"f;$g`, "h:i"}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"make", "SRCS := \\\n  a\\ b/c\\#d \\\n  e\"f;$$g \\\n  h:i\n"},
+		{"cmake", "set(SRCS\n  \"a b/c#d\"\n" + `  "e\"f\;\$g"` + "\n  \"h:i\"\n)\n"},
+		{"ninja", "SRCS = $\n    a$ b/c#d $\n    e\"f;$$g $\n    h$:i\n"},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		manifestFormats[tt.format](&b, "SRCS", paths)
+		if got := b.String(); got != tt.want {
+			t.Errorf("%s manifest = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+// writeRecorder records each write made to it.
+type writeRecorder struct {
+	writes []string
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestAtomicWriter(t *testing.T) {
+	lines := []string{"a/b\n", "a/c\n", strings.Repeat("d", 100) + "\n"}
+	want := strings.Join(lines, "")
+	tests := []struct {
+		max   int64
+		spill bool
+	}{
+		{-1, false},
+		{int64(len(want)), false},
+		{10, true},
+	}
+	for _, tt := range tests {
+		var out writeRecorder
+		w := &atomicWriter{max: tt.max}
+		for _, l := range lines {
+			if _, err := w.Write([]byte(l)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// A walk killed at this point leaves stdout empty.
+		if len(out.writes) != 0 {
+			t.Errorf("max %d: %d writes before flush", tt.max, len(out.writes))
+		}
+		if spilled := w.tmp != nil; spilled != tt.spill {
+			t.Errorf("max %d: spilled to a file = %v, want %v", tt.max, spilled, tt.spill)
+		}
+		if err := w.flush(&out); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(out.writes, ""); got != want {
+			t.Errorf("max %d: flushed %q, want %q", tt.max, got, want)
+		}
+		if !tt.spill && len(out.writes) != 1 {
+			t.Errorf("max %d: flushed in %d writes, want 1", tt.max, len(out.writes))
+		}
+
+		// The writer is empty for the output following.
+		w.Write([]byte("e\n"))
+		var b bytes.Buffer
+		if err := w.flush(&b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != "e\n" {
+			t.Errorf("max %d: second flush wrote %q, want %q", tt.max, b.String(), "e\n")
+		}
+	}
+}
+
+func TestPathDiff(t *testing.T) {
+	d := newPathDiff(map[string]bool{"a": true, "b/c": true, "b/d": true, "e": true})
+	tests := []struct {
+		path, want string
+	}{
+		{"a", "a"},
+		{"b/c", "b/c"},
+		{"b/x", "+b/x"},
+		{"f", "+f"},
+	}
+	for _, tt := range tests {
+		if got := d.mark(tt.path); got != tt.want {
+			t.Errorf("mark(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+	if got, want := d.missing(), []string{"b/d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("missing() = %q, want %q", got, want)
+	}
+}
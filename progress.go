@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	foundCount   int64
+	dirCount     int64
+	queueDepth   int64 // directories found but not read yet
+	ignoredCount int64 // entries matching an ignore pattern
+	prunedCount  int64 // directories not walked into
+	deniedCount  int64 // directories which couldn't be read for lack of permission
+	errorCount   int64 // errors met during the walk
+	currentDir   atomic.Value
+)
+
+type progressStats struct {
+	FilesFound     int64   `json:"files_found"`
+	DirsVisited    int64   `json:"dirs_visited"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	Rate           float64 `json:"rate"`
+	CurrentDir     string  `json:"current_dir"`
+	QueueDepth     int64   `json:"queue_depth"`
+	Inaccessible   int64   `json:"inaccessible_dirs"`
+}
+
+func currentProgress(start time.Time) progressStats {
+	st := progressStats{
+		FilesFound:     atomic.LoadInt64(&foundCount),
+		DirsVisited:    atomic.LoadInt64(&dirCount),
+		QueueDepth:     atomic.LoadInt64(&queueDepth),
+		Inaccessible:   atomic.LoadInt64(&deniedCount),
+		ElapsedSeconds: time.Since(start).Seconds(),
+	}
+	if st.ElapsedSeconds > 0 {
+		st.Rate = float64(st.FilesFound) / st.ElapsedSeconds
+	}
+	st.CurrentDir, _ = currentDir.Load().(string)
+	return st
+}
+
+// walkStats is written by -walk-stats-file.
+type walkStats struct {
+	Files      int64   `json:"files"`
+	Dirs       int64   `json:"dirs"`
+	Errors     int64   `json:"errors"`
+	Rate       float64 `json:"rate"`
+	Elapsed    float64 `json:"elapsed"`
+	CurrentDir string  `json:"current_dir"`
+}
+
+func currentWalkStats(start time.Time) interface{} {
+	p := currentProgress(start)
+	return walkStats{
+		Files:      p.FilesFound,
+		Dirs:       p.DirsVisited,
+		Errors:     atomic.LoadInt64(&errorCount),
+		Rate:       p.Rate,
+		Elapsed:    p.ElapsedSeconds,
+		CurrentDir: p.CurrentDir,
+	}
+}
+
+// writeJSONFile replaces name with the JSON encoding of v, so readers
+// never see a partially written file.
+func writeJSONFile(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// startProgressFile writes the stats to name every interval until the
+// returned function is called, which writes the final state.
+func startProgressFile(name string, interval time.Duration, stats func(start time.Time) interface{}) func() {
+	start := time.Now()
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				writeJSONFile(name, stats(start))
+			case <-done:
+				writeJSONFile(name, stats(start))
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// startQueueDepth prints the number of directories waiting to be read to
+// stderr every interval until the returned function is called.
+func startQueueDepth(interval time.Duration) func() {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				fmt.Fprintf(os.Stderr, "queue depth: %d\n", atomic.LoadInt64(&queueDepth))
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// startMetrics serves the walk counters in the Prometheus text format at
+// /metrics on the port until the returned function is called.
+func startMetrics(port int) (func(), error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, m := range []struct {
+			name, typ, help string
+			v               *int64
+		}{
+			{"files_found_total", "counter", "Files found so far.", &foundCount},
+			{"files_dirs_visited_total", "counter", "Directories read so far.", &dirCount},
+			{"files_walk_errors_total", "counter", "Errors met during the walk.", &errorCount},
+			{"files_walk_queue_depth", "gauge", "Directories found but not read yet.", &queueDepth},
+		} {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.typ, m.name, atomic.LoadInt64(m.v))
+		}
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	return func() {
+		srv.Close()
+	}, nil
+}
+
+type progressEvent struct {
+	Type       string  `json:"type"`
+	Files      int64   `json:"files"`
+	Dirs       int64   `json:"dirs"`
+	Rate       float64 `json:"rate"`
+	CurrentDir string  `json:"current_dir"`
+}
+
+// startProgressSocket listens on the unix socket at name and sends
+// progress events as JSON lines to each client every interval, until the
+// returned function is called. Events are dropped for clients which don't
+// keep up.
+func startProgressSocket(name string, interval time.Duration) (func(), error) {
+	ln, err := net.Listen("unix", name)
+	if err != nil {
+		return nil, err
+	}
+	// Each client has a writer goroutine and a queue of one event.
+	var mu sync.Mutex
+	var clients []chan []byte
+	var wg sync.WaitGroup
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			events := make(chan []byte, 1)
+			mu.Lock()
+			clients = append(clients, events)
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer c.Close()
+				for b := range events {
+					c.SetWriteDeadline(time.Now().Add(interval))
+					if _, err := c.Write(b); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	send := func(st progressStats) {
+		b, _ := json.Marshal(progressEvent{"progress", st.FilesFound, st.DirsVisited, st.Rate, st.CurrentDir})
+		b = append(b, '\n')
+		mu.Lock()
+		defer mu.Unlock()
+		for _, events := range clients {
+			select {
+			case events <- b:
+			default:
+			}
+		}
+	}
+
+	start := time.Now()
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				send(currentProgress(start))
+			case <-done:
+				send(currentProgress(start))
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+		ln.Close()
+		mu.Lock()
+		for _, events := range clients {
+			close(events)
+		}
+		clients = nil
+		mu.Unlock()
+		wg.Wait()
+	}, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// dirCache keeps the entries of each directory keyed by the directory's
+// mtime, so unchanged directories can be listed without reading them.
+// Entries which were stat'd are served with their cached stat fields, so
+// a file rewritten in place keeps its old size and mtime until its
+// directory changes. Entries which were not stat'd are stat'd on first
+// use, like those read from the directory. It also keeps the -file-hook
+// result of each file keyed by its mtime.
+type dirCache struct {
+	mu    sync.Mutex
+	old   cacheFile
+	dirs  map[string]*cachedDir
+	hooks map[string]cachedHook
+}
+
+type cacheFile struct {
+	Dirs  map[string]*cachedDir `json:"dirs"`
+	Hooks map[string]cachedHook `json:"hooks,omitempty"`
+}
+
+type cachedHook struct {
+	Cmd     string `json:"cmd"`
+	ModTime int64  `json:"mtime"`
+	OK      bool   `json:"ok"`
+}
+
+type cachedDir struct {
+	ModTime int64         `json:"mtime"`
+	Entries []cachedEntry `json:"entries"`
+
+	dir string
+	fis []os.FileInfo // converted to Entries on save
+}
+
+// cachedEntry is a directory entry. Without Stat, only the type bits of
+// Mode are known.
+type cachedEntry struct {
+	Name    string      `json:"name"`
+	Mode    os.FileMode `json:"mode"`
+	Size    int64       `json:"size,omitempty"`
+	ModTime int64       `json:"mtime,omitempty"`
+	Stat    *fileStat   `json:"stat,omitempty"`
+}
+
+// newCachedEntry records fi, with its stat fields only when they have
+// been read already.
+func newCachedEntry(dir string, fi os.FileInfo) cachedEntry {
+	if l, ok := fi.(*lazyInfo); ok {
+		if !l.done || l.fi == nil {
+			return cachedEntry{Name: fi.Name(), Mode: l.Type()}
+		}
+		fi = l.fi
+	}
+	st := newFileStat(filepath.Join(dir, fi.Name()), fi)
+	return cachedEntry{
+		Name:    fi.Name(),
+		Mode:    fi.Mode(),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UnixNano(),
+		Stat:    &st,
+	}
+}
+
+// info returns the FileInfo of the entry in dir.
+func (e *cachedEntry) info(dir string) os.FileInfo {
+	if e.Stat == nil {
+		return &lazyInfo{DirEntry: cachedDirEntry{e, dir}}
+	}
+	return cachedInfo{e}
+}
+
+// cachedInfo is the FileInfo of a stat'd entry, whose Sys returns the
+// cached *fileStat like indexInfo.
+type cachedInfo struct {
+	e *cachedEntry
+}
+
+func (fi cachedInfo) Name() string       { return fi.e.Name }
+func (fi cachedInfo) Size() int64        { return fi.e.Size }
+func (fi cachedInfo) Mode() os.FileMode  { return fi.e.Mode }
+func (fi cachedInfo) ModTime() time.Time { return time.Unix(0, fi.e.ModTime) }
+func (fi cachedInfo) IsDir() bool        { return fi.e.Mode.IsDir() }
+func (fi cachedInfo) Sys() interface{}   { return fi.e.Stat }
+
+// cachedDirEntry is an entry which was not stat'd, and is stat'd when a
+// lazyInfo needs it.
+type cachedDirEntry struct {
+	e   *cachedEntry
+	dir string
+}
+
+func (de cachedDirEntry) Name() string      { return de.e.Name }
+func (de cachedDirEntry) IsDir() bool       { return de.e.Mode.IsDir() }
+func (de cachedDirEntry) Type() os.FileMode { return de.e.Mode.Type() }
+
+func (de cachedDirEntry) Info() (os.FileInfo, error) {
+	return lstat(filepath.Join(de.dir, de.e.Name))
+}
+
+// lstat is replaced by the tests to count the stats.
+var lstat = os.Lstat
+
+func loadDirCache(name string) *dirCache {
+	c := &dirCache{
+		dirs:  map[string]*cachedDir{},
+		hooks: map[string]cachedHook{},
+	}
+	b, err := os.ReadFile(name)
+	if err == nil {
+		json.Unmarshal(b, &c.old)
+	}
+	return c
+}
+
+// readDir lists p from the cache when its mtime is unchanged, stat'ing
+// the entries which -walk-stat-fields asks for and the cache lacks.
+func (c *dirCache) readDir(p string) ([]os.FileInfo, error) {
+	dfi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	mtime := dfi.ModTime().UnixNano()
+
+	c.mu.Lock()
+	old, ok := c.old.Dirs[p]
+	c.mu.Unlock()
+	var fis []os.FileInfo
+	if ok && old.ModTime == mtime {
+		fis = make([]os.FileInfo, len(old.Entries))
+		for i := range old.Entries {
+			fi := old.Entries[i].info(p)
+			if l, ok := fi.(*lazyInfo); ok {
+				if *statFields == "full" || *statFields == "basic" && l.Type().IsRegular() {
+					l.stat()
+				}
+			}
+			fis[i] = fi
+		}
+	} else {
+		fis, err = readDirEntries(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.mu.Lock()
+	c.dirs[p] = &cachedDir{ModTime: mtime, dir: p, fis: append([]os.FileInfo(nil), fis...)}
+	c.mu.Unlock()
+	return fis, nil
+}
+
+// hook returns the -file-hook result of cmd for path, running it unless
+// the file is unchanged since the result was cached.
+func (c *dirCache) hook(path, cmd string, run func(path string) bool) bool {
+	var mtime int64
+	if fi, err := os.Lstat(path); err == nil {
+		mtime = fi.ModTime().UnixNano()
+	}
+
+	c.mu.Lock()
+	h, ok := c.old.Hooks[path]
+	c.mu.Unlock()
+	if !ok || h.Cmd != cmd || h.ModTime != mtime {
+		h = cachedHook{Cmd: cmd, ModTime: mtime, OK: run(path)}
+	}
+
+	c.mu.Lock()
+	c.hooks[path] = h
+	c.mu.Unlock()
+	return h.OK
+}
+
+func (c *dirCache) save(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, d := range c.dirs {
+		d.Entries = make([]cachedEntry, 0, len(d.fis))
+		for _, fi := range d.fis {
+			if fi, ok := fi.(cachedInfo); ok {
+				d.Entries = append(d.Entries, *fi.e)
+				continue
+			}
+			d.Entries = append(d.Entries, newCachedEntry(d.dir, fi))
+		}
+	}
+	b, err := json.Marshal(cacheFile{c.dirs, c.hooks})
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
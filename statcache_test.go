@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirCacheHit(t *testing.T) {
+	defer func(f func(string) (os.FileInfo, error), fields string) {
+		lstat, *statFields = f, fields
+	}(lstat, *statFields)
+	*statFields = "none"
+
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := filepath.Join(t.TempDir(), "cache")
+
+	// The first run reads the directory and stats only "a".
+	c := loadDirCache(name)
+	fis, err := c.readDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		if fi.Name() == "a" {
+			fi.Size()
+		}
+	}
+	if err := c.save(name); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewriting "a" in place leaves the mtime of the directory alone.
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte("xyz"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var stats int
+	lstat = func(name string) (os.FileInfo, error) {
+		stats++
+		return os.Lstat(name)
+	}
+
+	c = loadDirCache(name)
+	fis, err = c.readDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != 0 {
+		t.Fatalf("readDir stat'd %d entries, want 0", stats)
+	}
+	want := map[string]int{"a": 0, "b": 1}
+	sizes := map[string]int64{}
+	for _, fi := range fis {
+		n := stats
+		sizes[fi.Name()] = fi.Size()
+		fileOwner(fi)
+		if stats-n != want[fi.Name()] {
+			t.Errorf("entry %s was stat'd %d times, want %d", fi.Name(), stats-n, want[fi.Name()])
+		}
+	}
+	if sizes["a"] != 1 || sizes["b"] != 1 {
+		t.Errorf("sizes = %v, want the cached size 1 for a", sizes)
+	}
+}
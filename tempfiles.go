@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// tempFilePatterns match the names of well-known temporary files, which
+// -ignore-temp-files adds to the ignore list.
+var tempFilePatterns = []string{
+	// editors
+	`~$`,
+	`\.sw[a-p]$`,
+	`^\.?#.*#$`,
+	`^\.#`,
+	`\.bak$`,
+	`\.orig$`,
+	`\.rej$`,
+	// OS and applications
+	`\.te?mp$`,
+	`^\.DS_Store$`,
+	`^\._`,
+	`^Thumbs\.db$`,
+	`^desktop\.ini$`,
+	`^~\$`,
+	`^\.nfs[0-9a-f]+$`,
+	`\.crdownload$`,
+	`\.part$`,
+	// build artifacts
+	`\.py[co]$`,
+	`^__pycache__$`,
+	`\.o$`,
+	`\.obj$`,
+}
+
+var tempFileRes []*regexp.Regexp
+
+// loadTempPatterns compiles the patterns in the file name, one per line,
+// or the built-in ones when name is empty.
+func loadTempPatterns(name string) ([]*regexp.Regexp, error) {
+	patterns := tempFilePatterns
+	if name != "" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		patterns = nil
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				patterns = append(patterns, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// isTempFile reports whether name matches one of the temporary file
+// patterns.
+func isTempFile(name string) bool {
+	for _, re := range tempFileRes {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func listTempPatterns(w io.Writer) error {
+	for _, p := range tempFilePatterns {
+		if _, err := fmt.Fprintln(w, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
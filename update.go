@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is set at build time with -ldflags "-X main.Version ...", to the
+// output of git describe followed by the branch in parentheses.
+var Version = "devel"
+
+const releasesURL = "https://api.github.com/repos/Songmu/files/releases/latest"
+
+type updateCheck struct {
+	Checked time.Time `json:"checked"`
+	Latest  string    `json:"latest"`
+}
+
+func updateCacheFile() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "files", "update_check.json"), nil
+}
+
+// latestRelease returns the tag of the latest release, asking GitHub at
+// most once a day.
+func latestRelease() (string, error) {
+	cache, err := updateCacheFile()
+	if err == nil {
+		var c updateCheck
+		if b, err := os.ReadFile(cache); err == nil && json.Unmarshal(b, &c) == nil {
+			if time.Since(c.Checked) < 24*time.Hour && c.Latest != "" {
+				return c.Latest, nil
+			}
+		}
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(releasesURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", releasesURL, resp.Status)
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", err
+	}
+
+	if cache != "" {
+		if b, err := json.Marshal(updateCheck{time.Now(), release.TagName}); err == nil {
+			if os.MkdirAll(filepath.Dir(cache), 0755) == nil {
+				os.WriteFile(cache, b, 0644)
+			}
+		}
+	}
+	return release.TagName, nil
+}
+
+// versionNumbers returns the dot separated numbers of a tag like v1.2.3,
+// ignoring anything after them such as "-3-gabcdef (master)".
+func versionNumbers(v string) []string {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "- "); i >= 0 {
+		v = v[:i]
+	}
+	return strings.Split(v, ".")
+}
+
+// newerVersion reports whether version a is newer than b, comparing the
+// dot separated numbers of tags like v1.2.3.
+func newerVersion(a, b string) bool {
+	as := versionNumbers(a)
+	bs := versionNumbers(b)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+func checkForUpdate() error {
+	latest, err := latestRelease()
+	if err != nil {
+		return err
+	}
+	if Version == "devel" || newerVersion(latest, Version) {
+		fmt.Fprintf(os.Stderr, "files %s is available (this is %s)\n", latest, Version)
+	}
+	return nil
+}
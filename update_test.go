@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestNewerVersion(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"v1.2.3", "v1.2.3", false},
+		{"v1.2.4", "v1.2.3", true},
+		{"v1.2.3", "v1.2.4", false},
+		{"v1.10.0", "v1.9.9", true},
+		{"v2", "v1.9", true},
+		{"v1.2.1", "v1.2", true},
+		{"v1.2", "v1.2.0", false},
+		{"v1.2.4", "v1.2.3 (master)", true},
+		{"v1.2.3", "v1.2.3-2-gabcdef (master)", false},
+		{"v1.3.0", "v1.2.3-2-gabcdef-dirty (topic)", true},
+	}
+	for _, tt := range tests {
+		if got := newerVersion(tt.a, tt.b); got != tt.want {
+			t.Errorf("newerVersion(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
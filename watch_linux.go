@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+type dirWatcher struct {
+	fd   int
+	mu   sync.Mutex
+	dirs map[int]string
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &dirWatcher{fd: fd, dirs: map[int]string{}}, nil
+}
+
+func (w *dirWatcher) add(dir string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.dirs[wd] = dir
+	w.mu.Unlock()
+	return nil
+}
+
+func (w *dirWatcher) run(fn func(path string, created, isDir bool)) error {
+	var buf [syscall.SizeofInotifyEvent * 4096]byte
+	for {
+		n, err := syscall.Read(w.fd, buf[:])
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			w.mu.Lock()
+			dir, ok := w.dirs[int(ev.Wd)]
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, int(ev.Wd))
+			}
+			w.mu.Unlock()
+			if !ok || len(name) == 0 {
+				continue
+			}
+
+			path := filepath.Join(dir, string(bytes.TrimRight(name, "\x00")))
+			isDir := ev.Mask&syscall.IN_ISDIR != 0
+			switch {
+			case ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+				fn(path, true, isDir)
+			case ev.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+				fn(path, false, isDir)
+			}
+		}
+	}
+}
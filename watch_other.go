@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+type dirWatcher struct{}
+
+func newDirWatcher() (*dirWatcher, error) {
+	return nil, errors.New("inotify is not supported on this platform")
+}
+
+func (w *dirWatcher) add(dir string) error {
+	return nil
+}
+
+func (w *dirWatcher) run(fn func(path string, created, isDir bool)) error {
+	return nil
+}
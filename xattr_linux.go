@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const xattrSupported = true
+
+func getxattr(path, name string) ([]byte, error) {
+	buf := make([]byte, 256)
+	for {
+		n, err := syscall.Getxattr(path, name, buf)
+		if err == syscall.ERANGE {
+			buf = make([]byte, len(buf)*2)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func permString(perm uint32) string {
+	b := []byte("---")
+	if perm&4 != 0 {
+		b[0] = 'r'
+	}
+	if perm&2 != 0 {
+		b[1] = 'w'
+	}
+	if perm&1 != 0 {
+		b[2] = 'x'
+	}
+	return string(b)
+}
+
+// fileACL returns the POSIX access ACL of path, derived from the mode
+// when the file has no extended ACL.
+func fileACL(path string) aclEntries {
+	b, err := getxattr(path, "system.posix_acl_access")
+	if err != nil || len(b) < 4 || binary.LittleEndian.Uint32(b) != 2 {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return nil
+		}
+		m := uint32(fi.Mode().Perm())
+		return aclEntries{
+			{"user", "", permString(m >> 6)},
+			{"group", "", permString(m >> 3)},
+			{"other", "", permString(m)},
+		}
+	}
+
+	var entries aclEntries
+	for b = b[4:]; len(b) >= 8; b = b[8:] {
+		tag := binary.LittleEndian.Uint16(b)
+		perm := permString(uint32(binary.LittleEndian.Uint16(b[2:])))
+		id := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(b[4:])), 10)
+		switch tag {
+		case 0x01:
+			entries = append(entries, aclEntry{"user", "", perm})
+		case 0x02:
+			if u, err := user.LookupId(id); err == nil {
+				id = u.Username
+			}
+			entries = append(entries, aclEntry{"user", id, perm})
+		case 0x04:
+			entries = append(entries, aclEntry{"group", "", perm})
+		case 0x08:
+			if g, err := user.LookupGroupId(id); err == nil {
+				id = g.Name
+			}
+			entries = append(entries, aclEntry{"group", id, perm})
+		case 0x10:
+			entries = append(entries, aclEntry{"mask", "", perm})
+		case 0x20:
+			entries = append(entries, aclEntry{"other", "", perm})
+		}
+	}
+	return entries
+}
+
+// fileSELinux returns the SELinux security context of path, or "" if it
+// has none.
+func fileSELinux(path string) string {
+	b, err := getxattr(path, "security.selinux")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(string(b), "\x00")
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+const xattrSupported = false
+
+func fileACL(path string) aclEntries {
+	return nil
+}
+
+func fileSELinux(path string) string {
+	return ""
+}